@@ -0,0 +1,147 @@
+package v1alpha1
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// +kubebuilder:webhook:path=/mutate-replica-example-com-v1alpha1-author,mutating=true,failurePolicy=fail,groups=replica.example.com,resources=configmapreplicas;namespacedconfigmapreplicas,verbs=create;update,versions=v1alpha1,name=author.replica.example.com
+
+// authorWebhookPath path the AuthorRecorder is served on
+const authorWebhookPath = "/mutate-replica-example-com-v1alpha1-author"
+
+// AuthorRecorder records the user changing the spec of a replica in the author
+// annotations, so the controller can check the user may write to every target
+// namespace. Annotations set by users are always overwritten
+// +kubebuilder:object:generate=false
+type AuthorRecorder struct {
+	Client client.Client
+	// Controller user the controller runs as, restoring a template for RollbackTo keeps the author
+	Controller string
+}
+
+// SetupAuthorWebhookWithManager registers the AuthorRecorder in the webhook server
+func SetupAuthorWebhookWithManager(mgr ctrl.Manager, controller string) {
+	mgr.GetWebhookServer().Register(authorWebhookPath, &webhook.Admission{Handler: &AuthorRecorder{Client: mgr.GetClient(), Controller: controller}})
+}
+
+// replicaObject fields of ConfigMapReplica and NamespacedConfigMapReplica the AuthorRecorder needs
+// +kubebuilder:object:generate=false
+type replicaObject struct {
+	Metadata struct {
+		Annotations map[string]string `json:"annotations,omitempty"`
+	} `json:"metadata"`
+	Spec ConfigMapReplicaSpec `json:"spec"`
+}
+
+// Handle implements admission.Handler
+func (a *AuthorRecorder) Handle(ctx context.Context, req admission.Request) admission.Response {
+	replica := replicaObject{}
+	if err := json.Unmarshal(req.Object.Raw, &replica); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	author := req.UserInfo.Username
+	groups := strings.Join(req.UserInfo.Groups, ",")
+	if req.Operation == admissionv1beta1.Update {
+		old := replicaObject{}
+		if err := json.Unmarshal(req.OldObject.Raw, &old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		// updates by the controller or to metadata keep the author of the spec,
+		// so does restoring the template the author asked to roll back to
+		rollback := a.Controller != "" && req.UserInfo.Username == a.Controller && old.Spec.RollbackTo != nil && replica.Spec.RollbackTo == nil
+		if rollback || equality.Semantic.DeepEqual(old.Spec, replica.Spec) {
+			author = old.Metadata.Annotations[AuthorAnnotation]
+			groups = old.Metadata.Annotations[AuthorGroupsAnnotation]
+		} else if response := a.checkServiceAccount(ctx, req, &replica.Spec, &old.Spec); response != nil {
+			return *response
+		}
+	} else if response := a.checkServiceAccount(ctx, req, &replica.Spec, nil); response != nil {
+		return *response
+	}
+
+	if replica.Metadata.Annotations[AuthorAnnotation] == author && replica.Metadata.Annotations[AuthorGroupsAnnotation] == groups {
+		return admission.Allowed("")
+	}
+
+	// patch a generic copy of the object so fields unknown to this version are kept
+	object := map[string]interface{}{}
+	if err := json.Unmarshal(req.Object.Raw, &object); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	metadata, _ := object["metadata"].(map[string]interface{})
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+		object["metadata"] = metadata
+	}
+	annotations, _ := metadata["annotations"].(map[string]interface{})
+	if annotations == nil {
+		annotations = map[string]interface{}{}
+		metadata["annotations"] = annotations
+	}
+	annotations[AuthorAnnotation] = author
+	annotations[AuthorGroupsAnnotation] = groups
+	if author == "" {
+		delete(annotations, AuthorAnnotation)
+		delete(annotations, AuthorGroupsAnnotation)
+	}
+
+	patched, err := json.Marshal(object)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, patched)
+}
+
+// checkServiceAccount denies setting or changing the service account of a replica
+// unless the user may impersonate it. Returns nil when the request is allowed
+func (a *AuthorRecorder) checkServiceAccount(ctx context.Context, req admission.Request, spec, old *ConfigMapReplicaSpec) *admission.Response {
+	account, ok, err := spec.ServiceAccount(req.Namespace)
+	if err != nil {
+		response := admission.Denied(err.Error())
+		return &response
+	}
+	if !ok || (old != nil && old.ServiceAccountName == spec.ServiceAccountName && old.ServiceAccountNamespace == spec.ServiceAccountNamespace) {
+		return nil
+	}
+
+	extra := make(map[string]authorizationv1.ExtraValue, len(req.UserInfo.Extra))
+	for k, v := range req.UserInfo.Extra {
+		extra[k] = authorizationv1.ExtraValue(v)
+	}
+	review := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   req.UserInfo.Username,
+			Groups: req.UserInfo.Groups,
+			UID:    req.UserInfo.UID,
+			Extra:  extra,
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: account.Namespace,
+				Verb:      "impersonate",
+				Resource:  "serviceaccounts",
+				Name:      account.Name,
+			},
+		},
+	}
+	if err = a.Client.Create(ctx, review); err != nil {
+		response := admission.Errored(http.StatusInternalServerError, err)
+		return &response
+	}
+	if !review.Status.Allowed {
+		response := admission.Denied(fmt.Sprintf("user %s may not impersonate service account %s", req.UserInfo.Username, account))
+		return &response
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ConfigMapAggregatorSpec defines the desired state of ConfigMapAggregator
+type ConfigMapAggregatorSpec struct {
+	// NamespaceSelector as namespace selector rule to collect configmaps from.
+	// An empty selector selects no namespace unless AllNamespaces is set
+	// +optional
+	NamespaceSelector map[string]string `json:"namespaceSelector,omitempty"`
+	// AllNamespaces collects from every namespace but the protected ones when NamespaceSelector is empty
+	// +optional
+	AllNamespaces bool `json:"allNamespaces,omitempty"`
+	// Namespaces to collect from by name, in addition to the selected ones.
+	// Protected namespaces are only collected from when listed here
+	// +optional
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// Selector label selector rule for the configmaps to collect
+	Selector map[string]string `json:"selector"`
+
+	// Target the ConfigMap where all collected keys are merged into.
+	// Keys are prefixed with the source namespace: <namespace>.<key>.
+	// A target in a protected namespace is only written when a ReplicationPolicy
+	// selecting the aggregator allows the namespace
+	Target ConfigMapReference `json:"target"`
+}
+
+// ConfigMapReference points to a ConfigMap
+type ConfigMapReference struct {
+	// Name of the ConfigMap
+	Name string `json:"name"`
+	// Namespace of the ConfigMap
+	Namespace string `json:"namespace"`
+}
+
+const (
+	// ReasonKeyConflict more than one source ConfigMap in a namespace has the same key
+	ReasonKeyConflict = "KeyConflict"
+)
+
+// ConfigMapAggregatorStatus defines the observed state of ConfigMapAggregator
+type ConfigMapAggregatorStatus struct {
+	// Sources ConfigMaps merged into the target
+	// +optional
+	Sources []ConfigMapReference `json:"sources,omitempty"`
+	// Keys number of keys in the target
+	// +optional
+	Keys int `json:"keys,omitempty"`
+	// Ready returns true when the target is up to date
+	Ready bool `json:"ready"`
+	// Reason for not being ready. CamelCase
+	// +optional
+	Reason string `json:"reason,omitempty"`
+	// Message detail for Reason
+	// +optional
+	Message string `json:"message,omitempty"`
+	// Last time the target was synced
+	// +optional
+	LastSyncTime metav1.Time `json:"lastSyncTime,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:subresource:status
+
+// ConfigMapAggregator is the Schema for the configmapaggregators API
+// It is the inverse of a ConfigMapReplica: it collects ConfigMaps from many namespaces into one
+type ConfigMapAggregator struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ConfigMapAggregatorSpec   `json:"spec,omitempty"`
+	Status ConfigMapAggregatorStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ConfigMapAggregatorList contains a list of ConfigMapAggregator
+type ConfigMapAggregatorList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ConfigMapAggregator `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ConfigMapAggregator{}, &ConfigMapAggregatorList{})
+}
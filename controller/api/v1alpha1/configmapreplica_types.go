@@ -1,7 +1,11 @@
 package v1alpha1
 
 import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 // ConfigMapReplicaSpec defines the desired state of ConfigMapReplica
@@ -9,17 +13,288 @@ type ConfigMapReplicaSpec struct {
 	// Template defines the data that should be replicated
 	Template ConfigMapTemplate `json:"template"`
 
-	// Selector as namespace selector rule to replicate configmaps to
-	Selector map[string]string `json:"selector"`
+	// Selector as namespace selector rule to replicate configmaps to.
+	// An empty selector selects no namespace unless AllNamespaces is set.
+	// Protected namespaces are never selected, they must be listed in Namespaces
+	// +optional
+	Selector map[string]string `json:"selector,omitempty"`
+
+	// AllNamespaces must be set for an empty Selector to select all namespaces
+	// +optional
+	AllNamespaces bool `json:"allNamespaces,omitempty"`
+
+	// Namespaces to replicate to in addition to the selected ones.
+	// Protected namespaces must be listed here and allowed by a ReplicationPolicy
+	// +optional
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// Clusters remote clusters to also replicate to, using the same selector.
+	// Only available to cluster scoped ConfigMapReplicas. The author or service account
+	// of the replica must be allowed to get the kubeconfig Secrets. Copies are written
+	// with the identity of the kubeconfig, which is what limits where they may go
+	// +optional
+	Clusters []ClusterReference `json:"clusters,omitempty"`
+
+	// Source external data merged over the template data
+	// +optional
+	Source *ConfigMapSource `json:"source,omitempty"`
+
+	// ServiceAccountName service account whose permissions are checked before
+	// writing a copy. When empty the user who last changed the spec is checked.
+	// Setting it requires permission to impersonate the service account
+	// +optional
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+	// ServiceAccountNamespace namespace of the service account. Required for
+	// ConfigMapReplicas, NamespacedConfigMapReplicas can only use their own namespace
+	// +optional
+	ServiceAccountNamespace string `json:"serviceAccountNamespace,omitempty"`
+
+	// ConflictPolicy what to do when a ConfigMap not managed by the replica
+	// already exists in a target namespace. Defaults to Skip
+	// +optional
+	ConflictPolicy ConflictPolicy `json:"conflictPolicy,omitempty"`
+	// DriftPolicy what to do when a copy was changed outside the replica. Defaults to Correct
+	// +optional
+	DriftPolicy DriftPolicy `json:"driftPolicy,omitempty"`
+	// DeletionPolicy what happens to the copies when the replica is deleted. Defaults to Delete
+	// +optional
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+
+	// Decryption key used to decrypt Template.EncryptedData
+	// +optional
+	Decryption *Decryption `json:"decryption,omitempty"`
+
+	// Quota limits the copies and bytes the replica may write across namespaces
+	// +optional
+	Quota *ReplicaQuota `json:"quota,omitempty"`
+
+	// RolloutStrategy updates copies in waves instead of all at once
+	// +optional
+	RolloutStrategy *RolloutStrategy `json:"rolloutStrategy,omitempty"`
+
+	// RolloutConsumers restarts the Deployments, StatefulSets and DaemonSets referencing
+	// a copy when its data changes, by setting a pod template annotation to its content hash.
+	// Only kinds the author or service account may patch in the namespace are restarted,
+	// the copy status message lists the others
+	// +optional
+	RolloutConsumers bool `json:"rolloutConsumers,omitempty"`
+
+	// Suspend stops all writes to copies, the copy statuses keep reporting drift.
+	// Clearing it syncs the replica right away
+	// +optional
+	Suspend bool `json:"suspend,omitempty"`
+
+	// Mode Apply writes the copies, Plan only reports the writes it would make in Status.Plan.
+	// Defaults to Apply
+	// +optional
+	Mode ReplicaMode `json:"mode,omitempty"`
+
+	// RevisionHistoryLimit number of template revisions kept besides the current
+	// and update revisions. Defaults to 10
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	RevisionHistoryLimit *int32 `json:"revisionHistoryLimit,omitempty"`
+
+	// RollbackTo template revision restored into Template. The controller clears it once restored
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	RollbackTo *int64 `json:"rollbackTo,omitempty"`
+
+	// MaxChanges number of copies a single sync may create, update or delete.
+	// Larger syncs wait for the ApprovedGenerationAnnotation. Can only lower the
+	// limit configured in the controller
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxChanges *int32 `json:"maxChanges,omitempty"`
+
+	// Windows maintenance windows copies are written in. A namespace matching the selector
+	// of any window is only written while one of its windows is open, other namespaces are
+	// written at any time. Pending writes are reported with the PendingWindow reason
+	// +optional
+	Windows []MaintenanceWindow `json:"windows,omitempty"`
+
+	// Validation formats and schemas the data must match. The data is validated once
+	// per sync before any copy is written, invalid data is reported in the
+	// ValidationFailed condition and leaves the copies untouched
+	// +optional
+	Validation []DataValidation `json:"validation,omitempty"`
+
+	// Sharding splits data too large for one ConfigMap across the ConfigMaps <name>-0 to
+	// <name>-N. The copy named <name> then becomes an index listing the shards
+	// +optional
+	Sharding *Sharding `json:"sharding,omitempty"`
+}
+
+// Sharding splits oversized data across several ConfigMaps
+type Sharding struct {
+	// MaxShardBytes data size of a shard, keys included. Data up to this size is not
+	// sharded, larger values are split in chunks. Defaults to 900KiB, leaving room
+	// for the metadata under the 1MiB limit of a ConfigMap
+	// +kubebuilder:validation:Minimum=1024
+	// +kubebuilder:validation:Maximum=1048576
+	// +optional
+	MaxShardBytes *int32 `json:"maxShardBytes,omitempty"`
+}
+
+// Decryption age identities used to decrypt template data
+type Decryption struct {
+	// SecretRef Secret holding the age identities, one per line as written by age-keygen.
+	// NamespacedConfigMapReplicas can only use Secrets in their own namespace, and the author or
+	// service account of the replica must be allowed to get the Secret
+	SecretRef SecretReference `json:"secretRef"`
+	// Key in the Secret data. Defaults to age.agekey
+	// +optional
+	Key string `json:"key,omitempty"`
+}
+
+// ConflictPolicy what to do with an existing ConfigMap not managed by the replica
+// +kubebuilder:validation:Enum=Skip;Adopt
+type ConflictPolicy string
+
+const (
+	// ConflictPolicySkip leaves the ConfigMap untouched and reports a Conflict
+	ConflictPolicySkip ConflictPolicy = "Skip"
+	// ConflictPolicyAdopt takes over the ConfigMap unless another controller owns it
+	ConflictPolicyAdopt ConflictPolicy = "Adopt"
+)
+
+// DriftPolicy what to do with a copy changed outside the replica
+// +kubebuilder:validation:Enum=Correct;Report
+type DriftPolicy string
+
+const (
+	// DriftPolicyCorrect overwrites the changes
+	DriftPolicyCorrect DriftPolicy = "Correct"
+	// DriftPolicyReport keeps the changes and reports the copy as Drifted until it is restored or deleted
+	DriftPolicyReport DriftPolicy = "Report"
+)
+
+// ReplicaMode whether a replica writes its copies
+// +kubebuilder:validation:Enum=Apply;Plan
+type ReplicaMode string
+
+const (
+	// ReplicaModeApply writes the copies
+	ReplicaModeApply ReplicaMode = "Apply"
+	// ReplicaModePlan computes the writes without making them
+	ReplicaModePlan ReplicaMode = "Plan"
+)
+
+// DeletionPolicy what happens to the copies of a deleted replica
+// +kubebuilder:validation:Enum=Delete;Orphan;Retain
+type DeletionPolicy string
+
+const (
+	// DeletionPolicyDelete deletes all copies
+	DeletionPolicyDelete DeletionPolicy = "Delete"
+	// DeletionPolicyOrphan keeps the copies as plain ConfigMaps, removing
+	// the owner reference and the labels marking them as managed
+	DeletionPolicyOrphan DeletionPolicy = "Orphan"
+	// DeletionPolicyRetain keeps the copies untouched. Only the owner reference
+	// is removed so the garbage collector does not delete them
+	DeletionPolicyRetain DeletionPolicy = "Retain"
+)
+
+// ServiceAccount returns the service account of a replica living in namespace,
+// empty for cluster scoped replicas. ok is false when no service account is set
+func (s *ConfigMapReplicaSpec) ServiceAccount(namespace string) (account types.NamespacedName, ok bool, err error) {
+	if s.ServiceAccountName == "" {
+		return account, false, nil
+	}
+	account = types.NamespacedName{Namespace: s.ServiceAccountNamespace, Name: s.ServiceAccountName}
+	switch {
+	case namespace == "" && account.Namespace == "":
+		err = fmt.Errorf("serviceAccountNamespace is required")
+	case namespace != "" && account.Namespace != "" && account.Namespace != namespace:
+		err = fmt.Errorf("serviceAccountNamespace must be %s", namespace)
+	case namespace != "":
+		account.Namespace = namespace
+	}
+	return account, true, err
+}
+
+// ConfigMapSource external source of replicated data
+type ConfigMapSource struct {
+	// HTTP fetches a JSON or YAML document over HTTP
+	// +optional
+	HTTP *HTTPSource `json:"http,omitempty"`
+}
+
+// HTTPSource a JSON or YAML document published over HTTP. Documents may be up to 1MiB,
+// or 16MiB when the replica shards its data
+type HTTPSource struct {
+	// URL of the document
+	URL string `json:"url"`
+	// Interval between fetches. Defaults to 5m
+	// +optional
+	Interval *metav1.Duration `json:"interval,omitempty"`
+	// HeadersFromSecret Secret whose keys and values are sent as request headers.
+	// NamespacedConfigMapReplicas can only use Secrets in their own namespace, and the author or
+	// service account of the replica must be allowed to get the Secret
+	// +optional
+	HeadersFromSecret *SecretReference `json:"headersFromSecret,omitempty"`
+	// KeyMapping maps ConfigMap keys to dot separated paths in the document.
+	// When empty each top level field of the document becomes a key.
+	// String values are copied as is, other values are encoded as JSON
+	// +optional
+	KeyMapping map[string]string `json:"keyMapping,omitempty"`
+}
+
+// SecretReference points to a Secret
+type SecretReference struct {
+	// Namespace of the Secret. Defaults to the replica namespace
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+	// Name of the Secret
+	Name string `json:"name"`
+}
+
+// ClusterReference a remote cluster reachable with a kubeconfig stored in a Secret
+type ClusterReference struct {
+	// Name of the cluster as reported in the copy statuses
+	Name string `json:"name"`
+	// SecretRef Secret holding the kubeconfig
+	SecretRef SecretKeyReference `json:"secretRef"`
+}
+
+// SecretKeyReference selects a key of a Secret
+type SecretKeyReference struct {
+	// Namespace of the Secret
+	Namespace string `json:"namespace"`
+	// Name of the Secret
+	Name string `json:"name"`
+	// Key in the Secret data. Defaults to kubeconfig
+	// +optional
+	Key string `json:"key,omitempty"`
 }
 
 // ConfigMapTemplate template data for all replicated ConfigMaps
 type ConfigMapTemplate struct {
+	// Name of the replicated ConfigMap. Defaults to the replica name
+	// +optional
+	Name string `json:"name,omitempty"`
 	// Labels to be given to replicated ConfigMap
 	// +optional
 	Labels map[string]string `json:"labels,omitempty"`
 	// Data to be replicated
 	Data map[string]string `json:"data,omitempty"`
+	// EncryptedData age encrypted values, ASCII armored or base64 encoded, decrypted
+	// with the identities in spec.decryption and merged over Data
+	// +optional
+	EncryptedData map[string]string `json:"encryptedData,omitempty"`
+}
+
+// DataSize returns the size of the template data in bytes, keys included.
+// Encrypted values are counted encrypted, which is larger than their plaintext
+func (t *ConfigMapTemplate) DataSize() int {
+	size := 0
+	for k, v := range t.Data {
+		size += len(k) + len(v)
+	}
+	for k, v := range t.EncryptedData {
+		size += len(k) + len(v)
+	}
+	return size
 }
 
 // ConfigMapReplicaStatus defines the observed state of ConfigMapReplica
@@ -27,10 +302,138 @@ type ConfigMapReplicaStatus struct {
 	// Status for each configmap
 	// +optional
 	ConfigMapStatuses []ConfigMapReplicaCopy `json:"configMapStatuses,omitempty"`
+	// Conditions of the replica as a whole
+	// +optional
+	Conditions []ConfigMapReplicaCondition `json:"conditions,omitempty"`
+	// Usage copies written and the bytes they hold
+	// +optional
+	Usage ReplicaUsage `json:"usage,omitempty"`
+	// Consumers number of workloads referencing the copies
+	// +optional
+	Consumers int32 `json:"consumers,omitempty"`
+	// CurrentRevision template revision all copies were last synced to
+	// +optional
+	CurrentRevision int64 `json:"currentRevision,omitempty"`
+	// UpdateRevision template revision of the current spec
+	// +optional
+	UpdateRevision int64 `json:"updateRevision,omitempty"`
+	// Rollout progress of the rollout strategy
+	// +optional
+	Rollout *RolloutStatus `json:"rollout,omitempty"`
+	// Plan writes the replica would make, only set in Plan mode
+	// +optional
+	Plan *ReplicaPlan `json:"plan,omitempty"`
 }
 
+// ConfigMapReplicaConditionType type of a replica condition
+type ConfigMapReplicaConditionType string
+
+const (
+	// ConditionSourceFetchFailed the source could not be fetched, copies keep the last good data
+	ConditionSourceFetchFailed ConfigMapReplicaConditionType = "SourceFetchFailed"
+	// ConditionDecryptionFailed encrypted data could not be decrypted, copies keep the last data
+	ConditionDecryptionFailed ConfigMapReplicaConditionType = "DecryptionFailed"
+	// ConditionQuotaExceeded the copies would exceed the replica or cluster quota, nothing was written
+	ConditionQuotaExceeded ConfigMapReplicaConditionType = "QuotaExceeded"
+	// ConditionDeleting the replica is being deleted, the message reports the progress
+	// of applying the deletion policy to its copies
+	ConditionDeleting ConfigMapReplicaConditionType = "Deleting"
+	// ConditionRolloutFailed consumers of updated copies degraded during verification,
+	// the copies were reverted and the rollout halted until the template changes
+	ConditionRolloutFailed ConfigMapReplicaConditionType = "RolloutFailed"
+	// ConditionRollbackFailed the revision in RollbackTo does not exist, the template is left as is
+	ConditionRollbackFailed ConfigMapReplicaConditionType = "RollbackFailed"
+	// ConditionSuspended the replica is suspended, nothing is written to the copies
+	ConditionSuspended ConfigMapReplicaConditionType = "Suspended"
+	// ConditionValidationFailed the data does not match spec.validation, nothing was written.
+	// The message names the key and the position of the error
+	ConditionValidationFailed ConfigMapReplicaConditionType = "ValidationFailed"
+	// ConditionBlastRadiusExceeded a sync would change more copies than allowed, nothing was written.
+	// The message lists the planned changes
+	ConditionBlastRadiusExceeded ConfigMapReplicaConditionType = "BlastRadiusExceeded"
+)
+
+// ConfigMapReplicaCondition a condition of the replica
+type ConfigMapReplicaCondition struct {
+	// Type of the condition
+	Type ConfigMapReplicaConditionType `json:"type"`
+	// Status of the condition, one of True, False, Unknown
+	Status corev1.ConditionStatus `json:"status"`
+	// Last time the condition transitioned
+	// +optional
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+	// Reason for the condition. CamelCase
+	// +optional
+	Reason string `json:"reason,omitempty"`
+	// Message detail for Reason
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	// OwnerUIDLabel is added to every copy with the UID of the replica managing it.
+	// Copies of namespaced replicas live in other namespaces and cannot use owner references
+	OwnerUIDLabel = "replica.example.com/owner-uid"
+
+	// ContentHashAnnotation hash of the data the replica last wrote to a copy, used to detect drift
+	ContentHashAnnotation = "replica.example.com/content-hash"
+
+	// ConsumerHashAnnotationPrefix prefix of the pod template annotation holding the content hash
+	// of a copy on consuming workloads, followed by the copy name
+	ConsumerHashAnnotationPrefix = "replica.example.com/configmap-"
+
+	// ManagedByLabel standard label added to the template of every replica and to their copies
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	// ManagedByValue value of ManagedByLabel
+	ManagedByValue = "configmapreplica-controller"
+	// NameLabel added to the template and the copies with the name of the replica
+	NameLabel = "replica.example.com/name"
+
+	// ApprovedGenerationAnnotation approves a sync exceeding MaxChanges. It is set to the generation
+	// and the hash of the planned writes given in the BlastRadiusExceeded condition, a different
+	// plan for the same generation needs a new approval
+	ApprovedGenerationAnnotation = "replica.example.com/approved-generation"
+
+	// ForcePruneAnnotation set to "true" on a replica to delete copies still referenced by workloads
+	ForcePruneAnnotation = "replica.example.com/force-prune"
+
+	// AuthorAnnotation user who last changed the replica spec, recorded at admission
+	AuthorAnnotation = "replica.example.com/author"
+	// AuthorGroupsAnnotation comma separated groups of the author
+	AuthorGroupsAnnotation = "replica.example.com/author-groups"
+)
+
+// Reasons used in ConfigMapReplicaCopy
+const (
+	// ReasonOutOfScope the namespace was selected but the replica is not allowed to write to it
+	ReasonOutOfScope = "OutOfScope"
+	// ReasonConflict a ConfigMap with the same name exists and is not managed by the replica
+	ReasonConflict = "Conflict"
+	// ReasonSyncFailed the copy could not be created or updated
+	ReasonSyncFailed = "SyncFailed"
+	// ReasonPolicyDenied a ReplicationPolicy does not allow the copy. The message names the policy
+	ReasonPolicyDenied = "PolicyDenied"
+	// ReasonClusterUnreachable a remote cluster could not be reached, none of its copies were synced
+	ReasonClusterUnreachable = "ClusterUnreachable"
+	// ReasonForbidden the author or service account of the replica may not write ConfigMaps to the namespace,
+	// or may not read the kubeconfig Secret of the cluster
+	ReasonForbidden = "Forbidden"
+	// ReasonDrifted the copy was changed outside the replica and DriftPolicy is Report
+	ReasonDrifted = "Drifted"
+	// ReasonSuspended the copy needs to be written but the replica is suspended
+	ReasonSuspended = "Suspended"
+	// ReasonInUse the copy should be deleted but workloads still reference it. The message lists them
+	ReasonInUse = "InUse"
+	// ReasonPendingWindow the copy needs to be written but its maintenance windows are closed.
+	// The message tells when the next one opens
+	ReasonPendingWindow = "PendingWindow"
+)
+
 // ConfigMapReplicaCopy a condition for one Copy
 type ConfigMapReplicaCopy struct {
+	// Cluster name of the remote cluster. Empty for the cluster the replica lives in
+	// +optional
+	Cluster string `json:"cluster,omitempty"`
 	// Name for resource
 	Name string `json:"name"`
 	// Namespace of resource
@@ -41,16 +444,24 @@ type ConfigMapReplicaCopy struct {
 	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
 	// Ready returns true when a configmap is ready
 	Ready bool `json:"ready"`
+	// Revision of the template data the copy holds
+	// +optional
+	Revision string `json:"revision,omitempty"`
 	// Reason for not being ready. CamelCase
 	// +optional
 	Reason string `json:"reason,omitempty"`
 	// Message detail for Reason
 	// +optional
 	Message string `json:"message,omitempty"`
+	// Consumers workloads referencing the copy, as Kind/name. Copies in remote clusters
+	// only list them while their deletion waits for them
+	// +optional
+	Consumers []string `json:"consumers,omitempty"`
 }
 
 // +kubebuilder:object:root=true
 // +kubebuilder:resource:scope=Cluster
+// +kubebuilder:subresource:status
 
 // ConfigMapReplica is the Schema for the configmapreplicas API
 type ConfigMapReplica struct {
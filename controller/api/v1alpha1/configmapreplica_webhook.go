@@ -0,0 +1,270 @@
+package v1alpha1
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// maxConfigMapSize data size limit of a ConfigMap enforced by the api server
+const maxConfigMapSize = 1024 * 1024
+
+// log is for logging in this package.
+var configmapreplicalog = logf.Log.WithName("configmapreplica-resource")
+
+// webhookClient reads namespaces and replica usage to check quotas on admission
+var webhookClient client.Reader
+
+func (r *ConfigMapReplica) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+// +kubebuilder:webhook:path=/mutate-replica-example-com-v1alpha1-configmapreplica,mutating=true,failurePolicy=fail,groups=replica.example.com,resources=configmapreplicas,verbs=create;update,versions=v1alpha1,name=mconfigmapreplica.replica.example.com
+
+var _ webhook.Defaulter = &ConfigMapReplica{}
+
+// Default implements webhook.Defaulter so a webhook will be registered for the type
+func (r *ConfigMapReplica) Default() {
+	configmapreplicalog.Info("default", "name", r.Name)
+	r.Spec.Default()
+	r.Spec.Template.setOwnerLabels(r.Name)
+}
+
+func (r *NamespacedConfigMapReplica) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+// +kubebuilder:webhook:path=/mutate-replica-example-com-v1alpha1-namespacedconfigmapreplica,mutating=true,failurePolicy=fail,groups=replica.example.com,resources=namespacedconfigmapreplicas,verbs=create;update,versions=v1alpha1,name=mnamespacedconfigmapreplica.replica.example.com
+
+var _ webhook.Defaulter = &NamespacedConfigMapReplica{}
+
+// Default implements webhook.Defaulter so a webhook will be registered for the type
+func (r *NamespacedConfigMapReplica) Default() {
+	configmapreplicalog.Info("default", "namespace", r.Namespace, "name", r.Name)
+	r.Spec.Default()
+	r.Spec.Template.setOwnerLabels(r.Name)
+}
+
+// setOwnerLabels adds the standard labels every copy of the replica name is found by
+func (t *ConfigMapTemplate) setOwnerLabels(name string) {
+	if t.Labels == nil {
+		t.Labels = map[string]string{}
+	}
+	t.Labels[ManagedByLabel] = ManagedByValue
+	t.Labels[NameLabel] = name
+}
+
+// +kubebuilder:webhook:verbs=create;update,path=/validate-replica-example-com-v1alpha1-configmapreplica,mutating=false,failurePolicy=fail,groups=replica.example.com,resources=configmapreplicas,versions=v1alpha1,name=vconfigmapreplica.replica.example.com
+// +kubebuilder:webhook:verbs=create;update,path=/validate-replica-example-com-v1alpha1-namespacedconfigmapreplica,mutating=false,failurePolicy=fail,groups=replica.example.com,resources=namespacedconfigmapreplicas,versions=v1alpha1,name=vnamespacedconfigmapreplica.replica.example.com
+
+const (
+	// validateWebhookPath path the ReplicaValidator is served on for ConfigMapReplicas
+	validateWebhookPath = "/validate-replica-example-com-v1alpha1-configmapreplica"
+	// validateNamespacedWebhookPath path the ReplicaValidator is served on for NamespacedConfigMapReplicas
+	validateNamespacedWebhookPath = "/validate-replica-example-com-v1alpha1-namespacedconfigmapreplica"
+)
+
+// ReplicaValidator rejects ConfigMapReplicas and NamespacedConfigMapReplicas whose spec
+// produces ConfigMaps the api server does not accept or already exceeds a quota
+// +kubebuilder:object:generate=false
+type ReplicaValidator struct {
+	// Client reads namespaces and the usage of the other replicas to check quotas
+	Client client.Reader
+	// ClusterQuota limits the copies of all replicas together, nil means no limit
+	ClusterQuota *ReplicaQuota
+	// TenantLabel namespace label NamespacedConfigMapReplicas are scoped by
+	TenantLabel string
+	// ProtectedNamespaces namespaces the controller only writes to when a replica lists them
+	ProtectedNamespaces []string
+}
+
+// SetupValidationWebhookWithManager registers the ReplicaValidator in the webhook server for both kinds
+func SetupValidationWebhookWithManager(mgr ctrl.Manager, clusterQuota *ReplicaQuota, tenantLabel string, protected []string) {
+	validator := &webhook.Admission{Handler: &ReplicaValidator{Client: mgr.GetClient(), ClusterQuota: clusterQuota, TenantLabel: tenantLabel, ProtectedNamespaces: protected}}
+	mgr.GetWebhookServer().Register(validateWebhookPath, validator)
+	mgr.GetWebhookServer().Register(validateNamespacedWebhookPath, validator)
+}
+
+// validatedObject fields of ConfigMapReplica and NamespacedConfigMapReplica the ReplicaValidator needs
+// +kubebuilder:object:generate=false
+type validatedObject struct {
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              ConfigMapReplicaSpec `json:"spec"`
+}
+
+// Handle implements admission.Handler. Allowed changes report how many namespaces of the
+// local cluster they touch in the response message and the namespaces audit annotation.
+// The admission.k8s.io/v1beta1 API served by this controller-runtime has no warnings, and
+// kubectl does not print the message of an allowed response, so the count is only visible
+// in the audit log of the api server
+func (v *ReplicaValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	replica := &validatedObject{}
+	if err := json.Unmarshal(req.Object.Raw, replica); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	kind := GroupVersion.WithKind(req.Kind.Kind).GroupKind()
+	configmapreplicalog.Info("validate "+strings.ToLower(string(req.Operation)), "kind", kind.Kind, "namespace", replica.Namespace, "name", replica.Name)
+
+	var inScope func(*corev1.Namespace) bool
+	if kind.Kind == "NamespacedConfigMapReplica" {
+		scope, err := v.tenantScope(ctx, replica.Namespace)
+		if err != nil {
+			return admission.Errored(http.StatusInternalServerError, err)
+		}
+		inScope = scope
+	}
+
+	path := field.NewPath("spec")
+	errs := replica.Spec.validate(path)
+	if len(errs) == 0 {
+		errs = replica.Spec.validateQuota(ctx, v.Client, v.ClusterQuota, replica.UID, v.ProtectedNamespaces, inScope, path)
+	}
+	if len(errs) > 0 {
+		return admission.Denied(apierrors.NewInvalid(kind, replica.Name, errs).Error())
+	}
+
+	touched, err := v.touchedNamespaces(ctx, req, &replica.Spec, inScope)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	resp := admission.Allowed("")
+	resp.Result.Message = fmt.Sprintf("change touches %d namespaces", touched)
+	resp.AuditAnnotations = map[string]string{"namespaces": strconv.Itoa(touched)}
+	return resp
+}
+
+// touchedNamespaces counts the namespaces the spec selects and, on update,
+// those the previous spec selected, whose copies are pruned or rewritten
+func (v *ReplicaValidator) touchedNamespaces(ctx context.Context, req admission.Request, spec *ConfigMapReplicaSpec, inScope func(*corev1.Namespace) bool) (int, error) {
+	if v.Client == nil {
+		return 0, nil
+	}
+	names, err := spec.selectedNamespaces(ctx, v.Client, v.ProtectedNamespaces, inScope)
+	if err != nil {
+		return 0, err
+	}
+	if req.Operation == admissionv1beta1.Update {
+		old := &validatedObject{}
+		if err = json.Unmarshal(req.OldObject.Raw, old); err != nil {
+			return 0, err
+		}
+		previous, err := old.Spec.selectedNamespaces(ctx, v.Client, v.ProtectedNamespaces, inScope)
+		if err != nil {
+			return 0, err
+		}
+		names = names.Union(previous)
+	}
+	return names.Len(), nil
+}
+
+// tenantScope returns whether a NamespacedConfigMapReplica in the home namespace may copy
+// to a namespace: the home namespace itself and those of the same tenant
+func (v *ReplicaValidator) tenantScope(ctx context.Context, home string) (func(*corev1.Namespace) bool, error) {
+	ns := &corev1.Namespace{}
+	if err := v.Client.Get(ctx, types.NamespacedName{Name: home}, ns); err != nil {
+		return nil, err
+	}
+	tenant := ns.Labels[v.TenantLabel]
+	return func(target *corev1.Namespace) bool {
+		return target.Name == home || (tenant != "" && target.Labels[v.TenantLabel] == tenant)
+	}, nil
+}
+
+// Default sets the policies left empty
+func (s *ConfigMapReplicaSpec) Default() {
+	if s.ConflictPolicy == "" {
+		s.ConflictPolicy = ConflictPolicySkip
+	}
+	if s.DriftPolicy == "" {
+		s.DriftPolicy = DriftPolicyCorrect
+	}
+	if s.Mode == "" {
+		s.Mode = ReplicaModeApply
+	}
+	if s.DeletionPolicy == "" {
+		s.DeletionPolicy = DeletionPolicyDelete
+	}
+}
+
+// validate checks the spec produces ConfigMaps the api server accepts
+func (s *ConfigMapReplicaSpec) validate(path *field.Path) field.ErrorList {
+	var errs field.ErrorList
+
+	selectorPath := path.Child("selector")
+	for k, v := range s.Selector {
+		for _, msg := range validation.IsQualifiedName(k) {
+			errs = append(errs, field.Invalid(selectorPath, k, msg))
+		}
+		for _, msg := range validation.IsValidLabelValue(v) {
+			errs = append(errs, field.Invalid(selectorPath.Key(k), v, msg))
+		}
+	}
+	if len(s.Selector) == 0 && !s.AllNamespaces && len(s.Namespaces) == 0 {
+		errs = append(errs, field.Required(selectorPath, "set allNamespaces to select all namespaces"))
+	}
+	if len(s.Selector) > 0 && s.AllNamespaces {
+		errs = append(errs, field.Invalid(path.Child("allNamespaces"), s.AllNamespaces, "can only be set with an empty selector"))
+	}
+	for i, ns := range s.Namespaces {
+		for _, msg := range validation.IsDNS1123Label(ns) {
+			errs = append(errs, field.Invalid(path.Child("namespaces").Index(i), ns, msg))
+		}
+	}
+
+	templatePath := path.Child("template")
+	if s.Template.Name != "" {
+		for _, msg := range validation.IsDNS1123Subdomain(s.Template.Name) {
+			errs = append(errs, field.Invalid(templatePath.Child("name"), s.Template.Name, msg))
+		}
+	}
+	for k := range s.Template.Data {
+		for _, msg := range validation.IsConfigMapKey(k) {
+			errs = append(errs, field.Invalid(templatePath.Child("data").Key(k), k, msg))
+		}
+	}
+	for k := range s.Template.EncryptedData {
+		for _, msg := range validation.IsConfigMapKey(k) {
+			errs = append(errs, field.Invalid(templatePath.Child("encryptedData").Key(k), k, msg))
+		}
+		if _, ok := s.Template.Data[k]; ok {
+			errs = append(errs, field.Duplicate(templatePath.Child("encryptedData").Key(k), k))
+		}
+	}
+	if len(s.Template.EncryptedData) > 0 && s.Decryption == nil {
+		errs = append(errs, field.Required(path.Child("decryption"), "required to decrypt template.encryptedData"))
+	}
+	if size := s.Template.DataSize(); size > maxConfigMapSize && s.Sharding == nil {
+		errs = append(errs, field.TooLong(templatePath.Child("data"), fmt.Sprintf("%d bytes", size), maxConfigMapSize))
+	}
+	if s.RolloutStrategy != nil {
+		errs = append(errs, s.RolloutStrategy.validate(path.Child("rolloutStrategy"))...)
+	}
+	errs = append(errs, validateDataValidation(s.Validation, path.Child("validation"))...)
+	for i := range s.Windows {
+		errs = append(errs, s.Windows[i].validate(path.Child("windows").Index(i))...)
+	}
+	if _, _, err := s.ServiceAccount(""); err != nil {
+		errs = append(errs, field.Invalid(path.Child("serviceAccountNamespace"), s.ServiceAccountNamespace, strings.TrimPrefix(err.Error(), "serviceAccountNamespace ")))
+	}
+	return errs
+}
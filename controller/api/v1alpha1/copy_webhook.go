@@ -0,0 +1,110 @@
+package v1alpha1
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// config/webhook/copy_webhook_patch.yaml limits the webhook to ConfigMaps with the OwnerUIDLabel.
+// failurePolicy is ignore so an unavailable controller does not block the copies of deleted replicas
+// +kubebuilder:webhook:path=/validate-v1-configmap-copy,mutating=false,failurePolicy=ignore,groups="",resources=configmaps,verbs=update;delete,versions=v1,name=copy.replica.example.com
+
+const (
+	// copyWebhookPath path the CopyProtector is served on
+	copyWebhookPath = "/validate-v1-configmap-copy"
+
+	// BreakGlassAnnotation set to "true" on a copy to allow editing or deleting it by hand
+	BreakGlassAnnotation = "replica.example.com/break-glass"
+)
+
+// DefaultCopyEditors users that may always change copies: the garbage collector
+// deletes copies of deleted replicas and the namespace controller those of deleted namespaces
+var DefaultCopyEditors = []string{
+	"system:serviceaccount:kube-system:generic-garbage-collector",
+	"system:serviceaccount:kube-system:namespace-controller",
+}
+
+// CopyProtector rejects updates and deletes of copies managed by a replica
+// unless made by one of the Editors or the copy carries the BreakGlassAnnotation
+// +kubebuilder:object:generate=false
+type CopyProtector struct {
+	Client client.Client
+	// Editors users allowed to change copies, the controller service account among them
+	Editors []string
+}
+
+// SetupCopyWebhookWithManager registers the CopyProtector in the webhook server
+func SetupCopyWebhookWithManager(mgr ctrl.Manager, editors []string) {
+	mgr.GetWebhookServer().Register(copyWebhookPath, &webhook.Admission{Handler: &CopyProtector{Client: mgr.GetClient(), Editors: editors}})
+}
+
+// Handle implements admission.Handler
+func (p *CopyProtector) Handle(ctx context.Context, req admission.Request) admission.Response {
+	old := &corev1.ConfigMap{}
+	if err := json.Unmarshal(req.OldObject.Raw, old); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	uid, ok := old.Labels[OwnerUIDLabel]
+	if !ok {
+		return admission.Allowed("")
+	}
+	for _, editor := range p.Editors {
+		if req.UserInfo.Username == editor {
+			return admission.Allowed("")
+		}
+	}
+
+	annotations := old.Annotations
+	if req.Operation == admissionv1beta1.Update {
+		current := &corev1.ConfigMap{}
+		if err := json.Unmarshal(req.Object.Raw, current); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		annotations = current.Annotations
+	}
+	if annotations[BreakGlassAnnotation] == "true" {
+		return admission.Allowed("break glass")
+	}
+
+	owner, err := p.owner(ctx, uid)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	// copies retained by a deleted replica are no longer managed
+	if owner == "" {
+		return admission.Allowed("replica is gone")
+	}
+	return admission.Denied(fmt.Sprintf("configmap is managed by %s, change the replica instead or set the %s annotation to true", owner, BreakGlassAnnotation))
+}
+
+// owner describes the replica managing a copy, empty when no replica has the uid
+func (p *CopyProtector) owner(ctx context.Context, uid string) (string, error) {
+	replicas := &ConfigMapReplicaList{}
+	if err := p.Client.List(ctx, replicas); err != nil {
+		return "", err
+	}
+	for _, item := range replicas.Items {
+		if string(item.UID) == uid {
+			return "ConfigMapReplica " + item.Name, nil
+		}
+	}
+	namespaced := &NamespacedConfigMapReplicaList{}
+	if err := p.Client.List(ctx, namespaced); err != nil {
+		return "", err
+	}
+	for _, item := range namespaced.Items {
+		if string(item.UID) == uid {
+			return fmt.Sprintf("NamespacedConfigMapReplica %s/%s", item.Namespace, item.Name), nil
+		}
+	}
+	return "", nil
+}
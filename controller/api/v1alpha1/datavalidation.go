@@ -0,0 +1,87 @@
+package v1alpha1
+
+import (
+	"github.com/xeipuuv/gojsonschema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// DataFormat format a data value must parse as
+// +kubebuilder:validation:Enum=json;yaml;toml;properties
+type DataFormat string
+
+const (
+	// DataFormatJSON a JSON document
+	DataFormatJSON DataFormat = "json"
+	// DataFormatYAML a YAML document
+	DataFormatYAML DataFormat = "yaml"
+	// DataFormatTOML a TOML document
+	DataFormatTOML DataFormat = "toml"
+	// DataFormatProperties a Java properties file
+	DataFormatProperties DataFormat = "properties"
+)
+
+// DataValidation checks the value of a data key before any copy is written
+type DataValidation struct {
+	// Key of the data to validate. Missing keys are not validated
+	Key string `json:"key"`
+	// Format the value must parse as
+	Format DataFormat `json:"format"`
+	// Schema JSON Schema the parsed value must match
+	// +optional
+	Schema *DataSchema `json:"schema,omitempty"`
+}
+
+// DataSchema JSON Schema given inline or stored in a ConfigMap, exactly one must be set
+type DataSchema struct {
+	// Inline JSON Schema document
+	// +optional
+	Inline string `json:"inline,omitempty"`
+	// ConfigMapRef key of a ConfigMap holding the JSON Schema document.
+	// NamespacedConfigMapReplicas can only use ConfigMaps in their own namespace
+	// +optional
+	ConfigMapRef *ConfigMapKeyReference `json:"configMapRef,omitempty"`
+}
+
+// ConfigMapKeyReference a key of a ConfigMap
+type ConfigMapKeyReference struct {
+	// Namespace of the ConfigMap. Defaults to the replica namespace
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+	// Name of the ConfigMap
+	Name string `json:"name"`
+	// Key in the ConfigMap data
+	Key string `json:"key"`
+}
+
+// validateDataValidation checks the keys are valid and distinct and the inline schemas compile
+func validateDataValidation(validations []DataValidation, path *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	keys := map[string]bool{}
+	for i, v := range validations {
+		keyPath := path.Index(i).Child("key")
+		for _, msg := range validation.IsConfigMapKey(v.Key) {
+			errs = append(errs, field.Invalid(keyPath, v.Key, msg))
+		}
+		if keys[v.Key] {
+			errs = append(errs, field.Duplicate(keyPath, v.Key))
+		}
+		keys[v.Key] = true
+
+		if v.Schema == nil {
+			continue
+		}
+		schemaPath := path.Index(i).Child("schema")
+		switch {
+		case v.Schema.Inline == "" && v.Schema.ConfigMapRef == nil:
+			errs = append(errs, field.Required(schemaPath, "set inline or configMapRef"))
+		case v.Schema.Inline != "" && v.Schema.ConfigMapRef != nil:
+			errs = append(errs, field.Invalid(schemaPath.Child("configMapRef"), v.Schema.ConfigMapRef.Name, "cannot be combined with inline"))
+		case v.Schema.Inline != "":
+			if _, err := gojsonschema.NewSchema(gojsonschema.NewStringLoader(v.Schema.Inline)); err != nil {
+				errs = append(errs, field.Invalid(schemaPath.Child("inline"), "", err.Error()))
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,32 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+
+// NamespacedConfigMapReplica is the Schema for the namespacedconfigmapreplicas API
+// It behaves like a ConfigMapReplica but can be created by tenants: copies are only
+// written to namespaces that belong to the same tenant as the replica namespace
+type NamespacedConfigMapReplica struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ConfigMapReplicaSpec   `json:"spec,omitempty"`
+	Status ConfigMapReplicaStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// NamespacedConfigMapReplicaList contains a list of NamespacedConfigMapReplica
+type NamespacedConfigMapReplicaList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []NamespacedConfigMapReplica `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&NamespacedConfigMapReplica{}, &NamespacedConfigMapReplicaList{})
+}
@@ -0,0 +1,46 @@
+package v1alpha1
+
+import (
+	"context"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// MatchingNamespaces returns the namespaces matching the label set or listed by name, sorted
+// by name. An empty set matches nothing unless all is set, and protected namespaces are only
+// returned when listed. Used by the controllers and the admission webhooks alike
+func MatchingNamespaces(ctx context.Context, c client.Reader, set map[string]string, all bool, listed []string, protected []string) ([]corev1.Namespace, error) {
+	var namespaces []corev1.Namespace
+	if len(set) > 0 || all {
+		list := &corev1.NamespaceList{}
+		if err := c.List(ctx, list, &client.ListOptions{LabelSelector: labels.SelectorFromSet(set)}); err != nil {
+			return nil, err
+		}
+		skipped := sets.NewString(protected...).Insert(listed...)
+		for _, ns := range list.Items {
+			if !skipped.Has(ns.Name) {
+				namespaces = append(namespaces, ns)
+			}
+		}
+	}
+
+	for _, name := range listed {
+		ns := corev1.Namespace{}
+		if err := c.Get(ctx, types.NamespacedName{Name: name}, &ns); err != nil {
+			// matched once it is created
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		namespaces = append(namespaces, ns)
+	}
+	sort.Slice(namespaces, func(i, j int) bool { return namespaces[i].Name < namespaces[j].Name })
+	return namespaces, nil
+}
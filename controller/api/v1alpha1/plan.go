@@ -0,0 +1,44 @@
+package v1alpha1
+
+// ReplicaPlan writes a replica in Plan mode would make
+type ReplicaPlan struct {
+	// ObservedGeneration generation of the replica the plan was computed for
+	ObservedGeneration int64 `json:"observedGeneration"`
+	// Changes planned writes, at most 100 are listed
+	// +optional
+	Changes []PlannedChange `json:"changes,omitempty"`
+	// Omitted number of planned writes not listed in Changes
+	// +optional
+	Omitted int32 `json:"omitted,omitempty"`
+}
+
+// PlannedChange a write to one copy
+type PlannedChange struct {
+	// Operation create, update or delete
+	Operation string `json:"operation"`
+	// Cluster name of the remote cluster. Empty for the cluster the replica lives in
+	// +optional
+	Cluster string `json:"cluster,omitempty"`
+	// Namespace of the copy
+	Namespace string `json:"namespace"`
+	// Name of the copy
+	Name string `json:"name"`
+	// Data keys the write adds, changes or removes. Values are never shown
+	// +optional
+	Data []KeyChange `json:"data,omitempty"`
+}
+
+// KeyChange change of one data key
+type KeyChange struct {
+	// Key of the data
+	Key string `json:"key"`
+	// Change Added, Changed or Removed
+	Change string `json:"change"`
+}
+
+// Key changes reported in KeyChange
+const (
+	KeyAdded   = "Added"
+	KeyChanged = "Changed"
+	KeyRemoved = "Removed"
+)
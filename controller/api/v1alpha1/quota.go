@@ -0,0 +1,129 @@
+package v1alpha1
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ReplicaQuota limits the copies of replicas
+type ReplicaQuota struct {
+	// MaxCopies maximum number of copies
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MaxCopies *int32 `json:"maxCopies,omitempty"`
+	// MaxBytes maximum bytes of data held by all copies together, keys included
+	// +optional
+	MaxBytes *resource.Quantity `json:"maxBytes,omitempty"`
+}
+
+// ReplicaUsage copies written by replicas and the bytes they hold
+type ReplicaUsage struct {
+	// Copies number of copies
+	Copies int64 `json:"copies"`
+	// Bytes data held by the copies, keys included
+	Bytes int64 `json:"bytes"`
+}
+
+// Add returns the sum of both usages
+func (u ReplicaUsage) Add(other ReplicaUsage) ReplicaUsage {
+	return ReplicaUsage{Copies: u.Copies + other.Copies, Bytes: u.Bytes + other.Bytes}
+}
+
+// Exceeds returns an error naming the first limit usage exceeds. A nil quota never exceeds
+func (q *ReplicaQuota) Exceeds(usage ReplicaUsage) error {
+	if q == nil {
+		return nil
+	}
+	if q.MaxCopies != nil && usage.Copies > int64(*q.MaxCopies) {
+		return fmt.Errorf("%d copies exceed the maximum of %d", usage.Copies, *q.MaxCopies)
+	}
+	if q.MaxBytes != nil && usage.Bytes > q.MaxBytes.Value() {
+		return fmt.Errorf("%d bytes exceed the maximum of %s", usage.Bytes, q.MaxBytes.String())
+	}
+	return nil
+}
+
+// ClusterUsage sums the usage reported by all replicas but exclude
+func ClusterUsage(ctx context.Context, c client.Reader, exclude types.UID) (ReplicaUsage, error) {
+	usage := ReplicaUsage{}
+	replicas := &ConfigMapReplicaList{}
+	if err := c.List(ctx, replicas); err != nil {
+		return usage, err
+	}
+	for _, item := range replicas.Items {
+		if item.UID != exclude {
+			usage = usage.Add(item.Status.Usage)
+		}
+	}
+	namespaced := &NamespacedConfigMapReplicaList{}
+	if err := c.List(ctx, namespaced); err != nil {
+		return usage, err
+	}
+	for _, item := range namespaced.Items {
+		if item.UID != exclude {
+			usage = usage.Add(item.Status.Usage)
+		}
+	}
+	return usage, nil
+}
+
+// estimateUsage estimates the usage of the spec from the namespaces it selects in the local
+// cluster, only counting those inScope accepts when set. Remote clusters and sources are only
+// counted by the controller
+func (s *ConfigMapReplicaSpec) estimateUsage(ctx context.Context, c client.Reader, protected []string, inScope func(*corev1.Namespace) bool) (ReplicaUsage, error) {
+	names, err := s.selectedNamespaces(ctx, c, protected, inScope)
+	if err != nil {
+		return ReplicaUsage{}, err
+	}
+	copies := int64(names.Len())
+	return ReplicaUsage{Copies: copies, Bytes: copies * int64(s.Template.DataSize())}, nil
+}
+
+// selectedNamespaces returns the existing namespaces of the local cluster the spec selects as the
+// controller does, protected namespaces only when listed, and only those inScope accepts when set
+func (s *ConfigMapReplicaSpec) selectedNamespaces(ctx context.Context, c client.Reader, protected []string, inScope func(*corev1.Namespace) bool) (sets.String, error) {
+	namespaces, err := MatchingNamespaces(ctx, c, s.Selector, s.AllNamespaces, s.Namespaces, protected)
+	if err != nil {
+		return nil, err
+	}
+	names := sets.NewString()
+	for i := range namespaces {
+		if inScope == nil || inScope(&namespaces[i]) {
+			names.Insert(namespaces[i].Name)
+		}
+	}
+	return names, nil
+}
+
+// validateQuota rejects specs that already exceed their own or the cluster quota
+// when written to the namespaces they select today
+func (s *ConfigMapReplicaSpec) validateQuota(ctx context.Context, c client.Reader, clusterQuota *ReplicaQuota, uid types.UID, protected []string, inScope func(*corev1.Namespace) bool, path *field.Path) field.ErrorList {
+	if c == nil || (s.Quota == nil && clusterQuota == nil) {
+		return nil
+	}
+	usage, err := s.estimateUsage(ctx, c, protected, inScope)
+	if err != nil {
+		return field.ErrorList{field.InternalError(path, err)}
+	}
+	if err := s.Quota.Exceeds(usage); err != nil {
+		return field.ErrorList{field.Forbidden(path.Child("quota"), err.Error())}
+	}
+	if clusterQuota == nil {
+		return nil
+	}
+	other, err := ClusterUsage(ctx, c, uid)
+	if err != nil {
+		return field.ErrorList{field.InternalError(path, err)}
+	}
+	if err := clusterQuota.Exceeds(usage.Add(other)); err != nil {
+		return field.ErrorList{field.Forbidden(path, "cluster quota: "+err.Error())}
+	}
+	return nil
+}
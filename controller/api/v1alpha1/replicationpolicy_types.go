@@ -0,0 +1,68 @@
+package v1alpha1
+
+import (
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ReplicationPolicySpec defines which replicas the policy applies to and what they are allowed to do
+type ReplicationPolicySpec struct {
+	// ReplicaSelector selects replicas by their labels.
+	// An empty selector matches all replicas
+	// +optional
+	ReplicaSelector *metav1.LabelSelector `json:"replicaSelector,omitempty"`
+
+	// ReplicaNamespaces restricts the policy to NamespacedConfigMapReplicas in these namespaces.
+	// When set the policy does not apply to cluster scoped ConfigMapReplicas
+	// +optional
+	ReplicaNamespaces []string `json:"replicaNamespaces,omitempty"`
+
+	// TargetNamespaces namespaces matched replicas may write to
+	// +optional
+	TargetNamespaces []string `json:"targetNamespaces,omitempty"`
+
+	// TargetNamespaceSelector selects namespaces matched replicas may write to.
+	// When neither TargetNamespaces nor TargetNamespaceSelector are set all namespaces are allowed
+	// +optional
+	TargetNamespaceSelector *metav1.LabelSelector `json:"targetNamespaceSelector,omitempty"`
+
+	// ProtectedNamespaces protected namespaces matched replicas may write to.
+	// Replicas must also list them in their Namespaces. ConfigMapAggregators
+	// matching ReplicaSelector may have their target in these namespaces
+	// +optional
+	ProtectedNamespaces []string `json:"protectedNamespaces,omitempty"`
+
+	// ReservedNames ConfigMap names matched replicas may not write
+	// +optional
+	ReservedNames []string `json:"reservedNames,omitempty"`
+
+	// MaxDataSize maximum size of the replicated data, keys and values included.
+	// Counts the data written to the copies, with the source and decrypted data
+	// +optional
+	MaxDataSize *resource.Quantity `json:"maxDataSize,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+
+// ReplicationPolicy is the Schema for the replicationpolicies API
+// All policies matching a replica must allow a copy for it to be written
+type ReplicationPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ReplicationPolicySpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ReplicationPolicyList contains a list of ReplicationPolicy
+type ReplicationPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ReplicationPolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ReplicationPolicy{}, &ReplicationPolicyList{})
+}
@@ -0,0 +1,117 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// PromotedWaveAnnotation promotes a rollout into a wave with ManualPromotion,
+// set to <wave>@<revision> as named in the rollout status message
+const PromotedWaveAnnotation = "replica.example.com/promoted-wave"
+
+// RolloutStrategy updates existing copies in ordered waves of namespaces.
+// New copies are always created right away
+type RolloutStrategy struct {
+	// Waves updated in order. Namespaces matching no wave are updated after the last one
+	// +kubebuilder:validation:MinItems=1
+	Waves []RolloutWave `json:"waves"`
+	// Pause between the end of a wave and the start of the next one
+	// +optional
+	Pause *metav1.Duration `json:"pause,omitempty"`
+	// Verification checks the workloads consuming updated copies before updating more.
+	// When they degrade the updated copies are reverted and the rollout halts
+	// +optional
+	Verification *RolloutVerification `json:"verification,omitempty"`
+}
+
+// RolloutVerification health checks of the workloads consuming updated copies
+type RolloutVerification struct {
+	// Window how long the consumers are watched after each batch of updates
+	Window metav1.Duration `json:"window"`
+	// MaxRestarts containers of consuming pods that may restart during the window
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MaxRestarts int32 `json:"maxRestarts,omitempty"`
+}
+
+// RolloutWave namespaces updated together
+type RolloutWave struct {
+	// Name of the wave, shown in the rollout status
+	Name string `json:"name"`
+	// Selector namespace labels of the wave, a namespace belongs to the first wave it matches.
+	// An empty selector matches all namespaces
+	// +optional
+	Selector map[string]string `json:"selector,omitempty"`
+	// BatchSize number or percentage of the namespaces of the wave updated at once.
+	// Defaults to the whole wave
+	// +optional
+	BatchSize *intstr.IntOrString `json:"batchSize,omitempty"`
+	// ManualPromotion waits for the PromotedWaveAnnotation before starting the wave
+	// +optional
+	ManualPromotion bool `json:"manualPromotion,omitempty"`
+}
+
+// DefaultWave name of the wave of namespaces matching no other wave
+const DefaultWave = "default"
+
+// RolloutStatus progress of the rollout of the current revision
+type RolloutStatus struct {
+	// Revision the copies are rolled out to
+	Revision string `json:"revision"`
+	// PreviousRevision the copies were on when the rollout started, restored when verification fails
+	// +optional
+	PreviousRevision string `json:"previousRevision,omitempty"`
+	// Wave being updated, empty once all copies are on Revision
+	// +optional
+	Wave string `json:"wave,omitempty"`
+	// LastTransitionTime when the rollout moved to Wave
+	// +optional
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+	// PausedUntil Wave does not start before this time, set when the previous wave completed
+	// +optional
+	PausedUntil *metav1.Time `json:"pausedUntil,omitempty"`
+	// VerificationStartTime when the consumers of the last updated copies started being verified
+	// +optional
+	VerificationStartTime *metav1.Time `json:"verificationStartTime,omitempty"`
+	// Message why the rollout waits, if it does
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// validate checks wave names are unique and selectors and batch sizes valid
+func (s *RolloutStrategy) validate(path *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	names := map[string]bool{DefaultWave: true}
+	for i, wave := range s.Waves {
+		wavePath := path.Child("waves").Index(i)
+		switch {
+		case wave.Name == "":
+			errs = append(errs, field.Required(wavePath.Child("name"), ""))
+		case names[wave.Name]:
+			errs = append(errs, field.Duplicate(wavePath.Child("name"), wave.Name))
+		}
+		names[wave.Name] = true
+		for k, v := range wave.Selector {
+			for _, msg := range validation.IsQualifiedName(k) {
+				errs = append(errs, field.Invalid(wavePath.Child("selector"), k, msg))
+			}
+			for _, msg := range validation.IsValidLabelValue(v) {
+				errs = append(errs, field.Invalid(wavePath.Child("selector").Key(k), v, msg))
+			}
+		}
+		if wave.BatchSize != nil {
+			if batch, err := intstr.GetValueFromIntOrPercent(wave.BatchSize, 100, true); err != nil || batch < 1 {
+				errs = append(errs, field.Invalid(wavePath.Child("batchSize"), wave.BatchSize.String(), "must be a positive number or percentage"))
+			}
+		}
+	}
+	if s.Verification != nil && s.Verification.Window.Duration <= 0 {
+		errs = append(errs, field.Invalid(path.Child("verification", "window"), s.Verification.Window.Duration.String(), "must be positive"))
+	}
+	if s.Pause != nil && s.Pause.Duration < 0 {
+		errs = append(errs, field.Invalid(path.Child("pause"), s.Pause.Duration.String(), "must not be negative"))
+	}
+	return errs
+}
@@ -0,0 +1,135 @@
+package v1alpha1
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// MaintenanceWindow recurring period in which copies may be written. Either Schedule
+// and Duration or Days, Start and End must be set
+type MaintenanceWindow struct {
+	// Schedule cron expression of the times the window opens, for example "0 22 * * 1-5"
+	// +optional
+	Schedule string `json:"schedule,omitempty"`
+	// Duration how long the window stays open after each Schedule time
+	// +optional
+	Duration *metav1.Duration `json:"duration,omitempty"`
+
+	// Days weekdays the window opens on: Mon, Tue, Wed, Thu, Fri, Sat or Sun
+	// +optional
+	Days []string `json:"days,omitempty"`
+	// Start time of day the window opens, as HH:MM
+	// +optional
+	Start string `json:"start,omitempty"`
+	// End time of day the window closes, as HH:MM. Windows ending before they start close the next day
+	// +optional
+	End string `json:"end,omitempty"`
+
+	// TimeZone IANA name of the time zone of the window. Defaults to UTC
+	// +optional
+	TimeZone string `json:"timeZone,omitempty"`
+	// Selector namespace labels the window applies to. Empty applies to all namespaces
+	// +optional
+	Selector map[string]string `json:"selector,omitempty"`
+}
+
+// weekdays abbreviations accepted in MaintenanceWindow.Days
+var weekdays = map[string]time.Weekday{
+	"Sun": time.Sunday, "Mon": time.Monday, "Tue": time.Tuesday, "Wed": time.Wednesday,
+	"Thu": time.Thursday, "Fri": time.Friday, "Sat": time.Saturday,
+}
+
+// Open returns whether the window is open at now and, when it is not, the next time it opens
+func (w *MaintenanceWindow) Open(now time.Time) (bool, time.Time, error) {
+	location := time.UTC
+	if w.TimeZone != "" {
+		var err error
+		if location, err = time.LoadLocation(w.TimeZone); err != nil {
+			return false, time.Time{}, err
+		}
+	}
+	now = now.In(location)
+
+	if w.Schedule != "" {
+		schedule, err := cron.ParseStandard(w.Schedule)
+		if err != nil {
+			return false, time.Time{}, err
+		}
+		if w.Duration == nil {
+			return false, time.Time{}, fmt.Errorf("schedule requires a duration")
+		}
+		// the window is open when it opened less than Duration ago
+		if opened := schedule.Next(now.Add(-w.Duration.Duration)); !opened.After(now) {
+			return true, time.Time{}, nil
+		}
+		return false, schedule.Next(now), nil
+	}
+
+	start, err := time.Parse("15:04", w.Start)
+	if err != nil {
+		return false, time.Time{}, fmt.Errorf("start: %v", err)
+	}
+	end, err := time.Parse("15:04", w.End)
+	if err != nil {
+		return false, time.Time{}, fmt.Errorf("end: %v", err)
+	}
+	length := end.Sub(start)
+	if length <= 0 {
+		length += 24 * time.Hour
+	}
+	days := map[time.Weekday]bool{}
+	for _, day := range w.Days {
+		weekday, ok := weekdays[day]
+		if !ok {
+			return false, time.Time{}, fmt.Errorf("unknown day %s", day)
+		}
+		days[weekday] = true
+	}
+	// the window opened yesterday may still be open, otherwise look for the next opening
+	for offset := -1; offset <= 7; offset++ {
+		day := now.AddDate(0, 0, offset)
+		opens := time.Date(day.Year(), day.Month(), day.Day(), start.Hour(), start.Minute(), 0, 0, location)
+		if !days[opens.Weekday()] {
+			continue
+		}
+		if !now.Before(opens) && now.Before(opens.Add(length)) {
+			return true, time.Time{}, nil
+		}
+		if opens.After(now) {
+			return false, opens, nil
+		}
+	}
+	return false, time.Time{}, fmt.Errorf("no days set")
+}
+
+// validate checks the window can be evaluated
+func (w *MaintenanceWindow) validate(path *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	switch {
+	case w.Schedule != "" && (len(w.Days) > 0 || w.Start != "" || w.End != ""):
+		errs = append(errs, field.Invalid(path.Child("schedule"), w.Schedule, "cannot be combined with days, start and end"))
+	case w.Schedule != "" && (w.Duration == nil || w.Duration.Duration <= 0):
+		errs = append(errs, field.Required(path.Child("duration"), "a positive duration is required with a schedule"))
+	case w.Schedule == "" && (len(w.Days) == 0 || w.Start == "" || w.End == ""):
+		errs = append(errs, field.Required(path.Child("schedule"), "set either schedule and duration or days, start and end"))
+	default:
+		if _, _, err := w.Open(time.Now()); err != nil {
+			errs = append(errs, field.Invalid(path, strings.Join(w.Days, ","), err.Error()))
+		}
+	}
+	for k, v := range w.Selector {
+		for _, msg := range validation.IsQualifiedName(k) {
+			errs = append(errs, field.Invalid(path.Child("selector"), k, msg))
+		}
+		for _, msg := range validation.IsValidLabelValue(v) {
+			errs = append(errs, field.Invalid(path.Child("selector").Key(k), v, msg))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	replicav1alpha1 "github.com/danielfbm/k8s-design-workshop/controller/api/v1alpha1"
+)
+
+// +kubebuilder:rbac:groups=authorization.k8s.io,resources=subjectaccessreviews,verbs=create
+
+// accessVerbs verbs the replica subject needs on ConfigMaps of a target namespace
+var accessVerbs = []string{"create", "update"}
+
+// accessReview checks the user a replica acts for may write ConfigMaps to a namespace.
+// The controller itself can write everywhere, without it anyone able to create
+// a replica could write to any namespace
+type accessReview struct {
+	user   string
+	groups []string
+	// problem why the user is unknown, every namespace is forbidden when set
+	problem string
+}
+
+// newAccessReview uses the service account of the replica or, when not set,
+// the author recorded by the AuthorRecorder webhook
+func newAccessReview(owner metav1.Object, spec *replicav1alpha1.ConfigMapReplicaSpec) *accessReview {
+	account, ok, err := spec.ServiceAccount(owner.GetNamespace())
+	switch {
+	case err != nil:
+		return &accessReview{problem: err.Error()}
+	case ok:
+		return &accessReview{
+			user:   "system:serviceaccount:" + account.Namespace + ":" + account.Name,
+			groups: []string{"system:serviceaccounts", "system:serviceaccounts:" + account.Namespace, "system:authenticated"},
+		}
+	}
+
+	author := owner.GetAnnotations()[replicav1alpha1.AuthorAnnotation]
+	if author == "" {
+		return &accessReview{problem: fmt.Sprintf("replica has no %s annotation nor serviceAccountName", replicav1alpha1.AuthorAnnotation)}
+	}
+	var groups []string
+	if value := owner.GetAnnotations()[replicav1alpha1.AuthorGroupsAnnotation]; value != "" {
+		groups = strings.Split(value, ",")
+	}
+	return &accessReview{user: author, groups: groups}
+}
+
+// check returns why writing to namespace is forbidden, empty when it is allowed
+func (a *accessReview) check(ctx context.Context, c client.Client, namespace string) (string, error) {
+	for _, verb := range accessVerbs {
+		if forbidden, err := a.allowed(ctx, c, namespace, verb, corev1.Resource("configmaps")); forbidden != "" || err != nil {
+			return forbidden, err
+		}
+	}
+	return "", nil
+}
+
+// allowed returns why the user may not use the verb on the resource in namespace, empty when it may
+func (a *accessReview) allowed(ctx context.Context, c client.Client, namespace, verb string, resource schema.GroupResource) (string, error) {
+	if a.problem != "" {
+		return a.problem, nil
+	}
+	review := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   a.user,
+			Groups: a.groups,
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      verb,
+				Group:     resource.Group,
+				Resource:  resource.Resource,
+			},
+		},
+	}
+	if err := c.Create(ctx, review); err != nil {
+		return "", err
+	}
+	if !review.Status.Allowed {
+		return fmt.Sprintf("%s may not %s %s in namespace %s", a.user, verb, resource.String(), namespace), nil
+	}
+	return "", nil
+}
+
+// readableSecret returns an error prefixed with field unless the user the replica acts for may
+// get Secrets in namespace. The controller can read every Secret, so Secrets referenced by a
+// replica are only used when its author could have read them
+func (r *replication) readableSecret(ctx context.Context, namespace, field string) error {
+	forbidden, err := newAccessReview(r.owner, r.spec).allowed(ctx, r.Client, namespace, "get", corev1.Resource("secrets"))
+	if err != nil {
+		return err
+	}
+	if forbidden != "" {
+		return fmt.Errorf("%s: %s", field, forbidden)
+	}
+	return nil
+}
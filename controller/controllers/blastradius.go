@@ -0,0 +1,54 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	replicav1alpha1 "github.com/danielfbm/k8s-design-workshop/controller/api/v1alpha1"
+)
+
+// maxListedChanges planned changes listed in the BlastRadiusExceeded condition
+const maxListedChanges = 20
+
+// maxChanges returns the lower of the controller and replica limits, 0 means no limit
+func maxChanges(global int, spec *replicav1alpha1.ConfigMapReplicaSpec) int {
+	if spec.MaxChanges == nil {
+		return global
+	}
+	if replica := int(*spec.MaxChanges); global == 0 || replica < global {
+		return replica
+	}
+	return global
+}
+
+// withinBlastRadius returns false when the plan makes more writes than allowed and was not
+// approved, setting the BlastRadiusExceeded condition. An approval only holds for the generation
+// and the planned writes it was given for, namespaces changing their labels or new namespaces
+// change the plan without changing the generation
+func (r *replication) withinBlastRadius(plan *replicationPlan) bool {
+	changes := plan.changes()
+	approval := fmt.Sprintf("%d-%s", r.owner.GetGeneration(), plan.changeSetHash())
+	if r.maxChanges == 0 || changes <= r.maxChanges || r.owner.GetAnnotations()[replicav1alpha1.ApprovedGenerationAnnotation] == approval {
+		removeCondition(r.status, replicav1alpha1.ConditionBlastRadiusExceeded)
+		return true
+	}
+
+	r.log.Info("blast radius exceeded, waiting for approval", "changes", changes, "max", r.maxChanges)
+	message := fmt.Sprintf("%d changes exceed the limit of %d, approve them with the annotation %s: %q. Planned: %s",
+		changes, r.maxChanges, replicav1alpha1.ApprovedGenerationAnnotation, approval, strings.Join(plan.describe(maxListedChanges), ", "))
+	setCondition(r.status, replicav1alpha1.ConditionBlastRadiusExceeded, corev1.ConditionTrue, "ApprovalRequired", message)
+	return false
+}
+
+// changeSetHash hash of all planned writes, independent of their order
+func (p *replicationPlan) changeSetHash() string {
+	descriptions := p.describe(-1)
+	sort.Strings(descriptions)
+	sum := sha256.Sum256([]byte(strings.Join(descriptions, "\n")))
+	return hex.EncodeToString(sum[:])[:10]
+}
@@ -0,0 +1,205 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	replicav1alpha1 "github.com/danielfbm/k8s-design-workshop/controller/api/v1alpha1"
+)
+
+// verificationInterval how often consumers are checked during a verification window
+const verificationInterval = 15 * time.Second
+
+// verifyRollout checks the consumers of the copies on the rollout revision. It returns false
+// when they degraded, in which case the copies are reverted and the rollout halted, and how
+// long to wait before checking again while the verification window is open
+func (r *replication) verifyRollout(ctx context.Context, plan *replicationPlan, staged [][]stagedUpdate) (time.Duration, bool) {
+	rollout := r.status.Rollout
+	verification := r.spec.RolloutStrategy.Verification
+	if verification == nil {
+		rollout.VerificationStartTime = nil
+		return 0, true
+	}
+
+	degraded, err := r.degradedConsumers(ctx, plan, rollout.VerificationStartTime.Time, int(verification.MaxRestarts))
+	if err != nil {
+		r.log.Error(err, "verifying consumers")
+		rollout.Message = "verifying consumers: " + err.Error()
+		return verificationInterval, true
+	}
+	if len(degraded) > 0 {
+		rollout.VerificationStartTime = nil
+		message := "consumers degraded: " + strings.Join(degraded, ", ")
+		if reverted, err := r.rollback(ctx, plan); err != nil {
+			r.log.Error(err, "reverting copies")
+			message += ", copies were not reverted: " + err.Error()
+		} else {
+			message += fmt.Sprintf(", copies reverted to template revision %d (%s)", r.status.CurrentRevision, reverted)
+		}
+		r.log.Info("rollout failed", "revision", rollout.Revision, "reason", message)
+		setCondition(r.status, replicav1alpha1.ConditionRolloutFailed, corev1.ConditionTrue, "ConsumersDegraded", message)
+		rollout.Message = "halted, change the template to roll out a new revision"
+		return 0, false
+	}
+
+	end := rollout.VerificationStartTime.Add(verification.Window.Duration)
+	if remaining := time.Until(end); remaining > 0 {
+		rollout.Message = fmt.Sprintf("verifying consumers until %s", end.UTC().Format(time.RFC3339))
+		if remaining > verificationInterval {
+			remaining = verificationInterval
+		}
+		return remaining, true
+	}
+	rollout.VerificationStartTime = nil
+	return 0, true
+}
+
+// degradedConsumers describes the consumers of copies on the plan revision that are
+// unavailable Deployments or pods with more than maxRestarts container restarts since since
+func (r *replication) degradedConsumers(ctx context.Context, plan *replicationPlan, since time.Time, maxRestarts int) ([]string, error) {
+	var degraded []string
+	for _, cp := range plan.clusters {
+		checked := map[string]bool{}
+		for _, status := range cp.statuses {
+			if !status.Ready || status.Revision != plan.revision || checked[status.Namespace] {
+				continue
+			}
+			checked[status.Namespace] = true
+			found, err := degradedInNamespace(ctx, cp.cluster, status.Namespace, status.Name, since, maxRestarts)
+			if err != nil {
+				return nil, err
+			}
+			for _, consumer := range found {
+				if !cp.cluster.local() {
+					consumer = cp.cluster.name + ":" + consumer
+				}
+				degraded = append(degraded, consumer)
+			}
+		}
+	}
+	return degraded, nil
+}
+
+// degradedInNamespace describes the unhealthy consumers of the ConfigMap name in namespace
+func degradedInNamespace(ctx context.Context, c client.Client, namespace, name string, since time.Time, maxRestarts int) ([]string, error) {
+	var degraded []string
+	deployments := &appsv1.DeploymentList{}
+	if err := c.List(ctx, deployments, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	for i := range deployments.Items {
+		deployment := &deployments.Items[i]
+		if !referencesConfigMap(&deployment.Spec.Template.Spec, name) {
+			continue
+		}
+		for _, condition := range deployment.Status.Conditions {
+			if condition.Type == appsv1.DeploymentAvailable && condition.Status == corev1.ConditionFalse {
+				degraded = append(degraded, fmt.Sprintf("%s/Deployment/%s is unavailable", namespace, deployment.Name))
+			}
+		}
+	}
+
+	pods := &corev1.PodList{}
+	if err := c.List(ctx, pods, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	restarts := 0
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if !referencesConfigMap(&pod.Spec, name) {
+			continue
+		}
+		statuses := append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+		for _, status := range statuses {
+			if terminated := status.LastTerminationState.Terminated; terminated != nil && !terminated.FinishedAt.Time.Before(since) {
+				restarts++
+			}
+		}
+	}
+	if restarts > maxRestarts {
+		degraded = append(degraded, fmt.Sprintf("%d containers of pods in %s restarted", restarts, namespace))
+	}
+	return degraded, nil
+}
+
+// rollback plans reverting the copies on the plan revision to the template of the current
+// revision, the last one all copies were synced to, rebuilding its data and shards from the
+// revision history. It returns the revision of the reverted data
+func (r *replication) rollback(ctx context.Context, plan *replicationPlan) (string, error) {
+	number := r.status.CurrentRevision
+	if number == 0 || number == r.status.UpdateRevision || r.history == nil {
+		return "", fmt.Errorf("the template did not change since the last synced revision")
+	}
+	template, err := r.history.template(ctx, number)
+	if err != nil {
+		return "", err
+	}
+	if template == nil {
+		return "", fmt.Errorf("template revision %d is not recorded anymore", number)
+	}
+
+	previous := *r
+	spec := *r.spec
+	spec.Template = *template
+	previous.spec = &spec
+	previous.decrypted = nil
+	if len(template.EncryptedData) > 0 {
+		if previous.decrypted, err = decryptData(ctx, r.secrets, r.owner.GetNamespace(), &spec); err != nil {
+			return "", err
+		}
+	}
+	base, err := previous.baseConfigMap()
+	if err != nil {
+		return "", err
+	}
+	shards, err := previous.shardBase(base)
+	if err != nil {
+		return "", err
+	}
+	revision := shortRevision(base.Annotations[replicav1alpha1.ContentHashAnnotation])
+
+	for _, cp := range plan.clusters {
+		clusterBase, clusterShards := base, shards
+		if !cp.cluster.local() {
+			clusterBase, clusterShards = remoteCopies(base, shards)
+		}
+		pending := make(map[int]bool, len(cp.actions))
+		// previous shards the data no longer needs are about to be pruned
+		pruned := map[string]int{}
+		for i, action := range cp.actions {
+			pending[action.status] = true
+			if action.operation == operationDelete {
+				pruned[action.current.Namespace+"/"+action.current.Name] = i
+			}
+		}
+		for i := range cp.statuses {
+			status := &cp.statuses[i]
+			if !status.Ready || status.Revision != plan.revision || pending[i] {
+				continue
+			}
+			result, actions, err := previous.planShardedCopy(ctx, cp.cluster, cp.log, clusterBase, clusterShards, status.Namespace)
+			if err != nil || result.reason != "" {
+				cp.log.Error(err, "planning copy revert", "namespace", status.Namespace, "reason", result.message)
+				continue
+			}
+			for _, action := range actions {
+				action.status = i
+				// the revert takes the place of the deletion, keeping the index of the other actions
+				if j, ok := pruned[action.object().Namespace+"/"+action.object().Name]; ok {
+					cp.actions[j] = action
+					continue
+				}
+				cp.actions = append(cp.actions, action)
+			}
+			status.Ready, status.Revision = len(actions) == 0, revision
+		}
+	}
+	r.status.Rollout.PreviousRevision = revision
+	return revision, nil
+}
@@ -0,0 +1,123 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	replicav1alpha1 "github.com/danielfbm/k8s-design-workshop/controller/api/v1alpha1"
+)
+
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get
+
+const (
+	// defaultKubeconfigKey Secret key used when a ClusterReference does not set one
+	defaultKubeconfigKey = "kubeconfig"
+	// remoteClusterTimeout keeps an unreachable cluster from stalling a reconcile
+	remoteClusterTimeout = 10 * time.Second
+	// remoteResyncPeriod remote clusters are not watched, replicas using them are resynced periodically
+	remoteResyncPeriod = 5 * time.Minute
+)
+
+// cluster a cluster copies are written to
+type cluster struct {
+	// name empty for the local cluster
+	name string
+	client.Client
+	// err why the cluster client could not be built
+	err error
+	// outOfScope why the replica may not write to this cluster
+	outOfScope string
+	// forbidden why the replica may not use the kubeconfig of this cluster
+	forbidden string
+}
+
+// local returns true for the cluster the replica lives in
+func (c *cluster) local() bool {
+	return c.name == ""
+}
+
+// clusterCache keeps one client per remote cluster. Clients are rebuilt
+// when the kubeconfig in the referenced Secret changes
+type clusterCache struct {
+	// reader reads Secrets without caching them in the manager
+	reader client.Reader
+	scheme *runtime.Scheme
+
+	mu      sync.Mutex
+	clients map[types.NamespacedName]cachedCluster
+}
+
+type cachedCluster struct {
+	// hash of the kubeconfig used to build client
+	hash   [sha256.Size]byte
+	client client.Client
+}
+
+func newClusterCache(reader client.Reader, scheme *runtime.Scheme) *clusterCache {
+	return &clusterCache{reader: reader, scheme: scheme, clients: map[types.NamespacedName]cachedCluster{}}
+}
+
+// clusters returns the remote clusters of a replica. Clusters that cannot be
+// reached are returned with err set so the others can still be synced.
+// The controller can read every Secret, so clusters whose kubeconfig Secret the
+// user the replica acts for may not get are returned with forbidden set, without
+// it anyone able to create a replica could borrow the credentials of another team
+func (c *clusterCache) clusters(ctx context.Context, local client.Client, access *accessReview, refs []replicav1alpha1.ClusterReference) []cluster {
+	clusters := make([]cluster, 0, len(refs))
+	for _, ref := range refs {
+		forbidden, err := access.allowed(ctx, local, ref.SecretRef.Namespace, "get", corev1.Resource("secrets"))
+		if err != nil || forbidden != "" {
+			clusters = append(clusters, cluster{name: ref.Name, err: err, forbidden: forbidden})
+			continue
+		}
+		cl, err := c.get(ctx, ref.SecretRef)
+		clusters = append(clusters, cluster{name: ref.Name, Client: cl, err: err})
+	}
+	return clusters
+}
+
+// get returns the client for the kubeconfig in a Secret
+func (c *clusterCache) get(ctx context.Context, ref replicav1alpha1.SecretKeyReference) (client.Client, error) {
+	key := ref.Key
+	if key == "" {
+		key = defaultKubeconfigKey
+	}
+	secret := &corev1.Secret{}
+	secretKey := types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}
+	if err := c.reader.Get(ctx, secretKey, secret); err != nil {
+		return nil, err
+	}
+	kubeconfig, ok := secret.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("secret %s has no key %s", secretKey, key)
+	}
+	hash := sha256.Sum256(kubeconfig)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, ok := c.clients[secretKey]; ok && cached.hash == hash {
+		return cached.client, nil
+	}
+
+	config, err := clientcmd.RESTConfigFromKubeConfig(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	config.Timeout = remoteClusterTimeout
+	// building the client runs discovery, so an unreachable cluster fails here and is not cached
+	cl, err := client.New(config, client.Options{Scheme: c.scheme})
+	if err != nil {
+		return nil, err
+	}
+	c.clients[secretKey] = cachedCluster{hash: hash, client: cl}
+	return cl, nil
+}
@@ -0,0 +1,63 @@
+package controllers
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	replicav1alpha1 "github.com/danielfbm/k8s-design-workshop/controller/api/v1alpha1"
+)
+
+// setCondition adds or updates a condition keeping its transition time when the status did not change
+func setCondition(status *replicav1alpha1.ConfigMapReplicaStatus, conditionType replicav1alpha1.ConfigMapReplicaConditionType, conditionStatus corev1.ConditionStatus, reason, message string) {
+	condition := replicav1alpha1.ConfigMapReplicaCondition{
+		Type:               conditionType,
+		Status:             conditionStatus,
+		LastTransitionTime: metav1.Now(),
+		Reason:             reason,
+		Message:            message,
+	}
+	for i, old := range status.Conditions {
+		if old.Type != conditionType {
+			continue
+		}
+		if old.Status == conditionStatus {
+			condition.LastTransitionTime = old.LastTransitionTime
+		}
+		status.Conditions[i] = condition
+		return
+	}
+	status.Conditions = append(status.Conditions, condition)
+}
+
+// findCondition returns the condition of the given type, nil when absent
+func findCondition(status *replicav1alpha1.ConfigMapReplicaStatus, conditionType replicav1alpha1.ConfigMapReplicaConditionType) *replicav1alpha1.ConfigMapReplicaCondition {
+	for i := range status.Conditions {
+		if status.Conditions[i].Type == conditionType {
+			return &status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// removeCondition removes a condition if present
+func removeCondition(status *replicav1alpha1.ConfigMapReplicaStatus, conditionType replicav1alpha1.ConfigMapReplicaConditionType) {
+	for i, old := range status.Conditions {
+		if old.Type == conditionType {
+			status.Conditions = append(status.Conditions[:i], status.Conditions[i+1:]...)
+			return
+		}
+	}
+}
+
+// statusChanged compares statuses ignoring copy probe times, which change on every sync
+func statusChanged(a, b *replicav1alpha1.ConfigMapReplicaStatus) bool {
+	return copyStatusesChanged(a.ConfigMapStatuses, b.ConfigMapStatuses) ||
+		!equality.Semantic.DeepEqual(a.Conditions, b.Conditions) ||
+		a.Usage != b.Usage ||
+		a.Consumers != b.Consumers ||
+		a.CurrentRevision != b.CurrentRevision ||
+		a.UpdateRevision != b.UpdateRevision ||
+		!equality.Semantic.DeepEqual(a.Rollout, b.Rollout) ||
+		!equality.Semantic.DeepEqual(a.Plan, b.Plan)
+}
@@ -0,0 +1,226 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	replicav1alpha1 "github.com/danielfbm/k8s-design-workshop/controller/api/v1alpha1"
+)
+
+// ConfigMapAggregatorReconciler reconciles a ConfigMapAggregator object
+type ConfigMapAggregatorReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+	// ProtectedNamespaces namespaces only collected from when listed in spec.namespaces,
+	// and only written to when a ReplicationPolicy allows it
+	ProtectedNamespaces []string
+}
+
+// +kubebuilder:rbac:groups=replica.example.com,resources=configmapaggregators,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=replica.example.com,resources=configmapaggregators/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+
+func (r *ConfigMapAggregatorReconciler) Reconcile(req ctrl.Request) (result ctrl.Result, err error) {
+	ctx := context.Background()
+	log := r.Log.WithValues("configmapaggregator", req.NamespacedName)
+
+	aggregator := &replicav1alpha1.ConfigMapAggregator{}
+	if err = r.Get(ctx, req.NamespacedName, aggregator); err != nil {
+		if errors.IsNotFound(err) {
+			err = nil
+		}
+		return
+	}
+
+	// making it editable
+	aggregator = aggregator.DeepCopy()
+	previous := aggregator.Status.DeepCopy()
+
+	data, sources, conflicts, err := r.collect(ctx, aggregator)
+	if err != nil {
+		log.Error(err, "collecting configmaps")
+		return
+	}
+
+	status := &aggregator.Status
+	status.Sources = sources
+	status.Keys = len(data)
+	status.Ready, status.Reason, status.Message = true, "", ""
+	if len(conflicts) > 0 {
+		status.Ready = false
+		status.Reason = replicav1alpha1.ReasonKeyConflict
+		status.Message = fmt.Sprintf("keys defined more than once, first configmap by name wins: %s", strings.Join(conflicts, ", "))
+	}
+	denied, err := r.protectedTarget(ctx, aggregator)
+	if err != nil {
+		log.Error(err, "listing replication policies")
+		return
+	}
+	if denied != "" {
+		status.Ready = false
+		status.Reason = replicav1alpha1.ReasonPolicyDenied
+		status.Message = denied
+	} else if err = r.syncTarget(ctx, log, aggregator, data); err != nil {
+		status.Ready = false
+		status.Reason = replicav1alpha1.ReasonSyncFailed
+		status.Message = err.Error()
+	}
+
+	previous.LastSyncTime = status.LastSyncTime
+	if !equality.Semantic.DeepEqual(previous, status) {
+		status.LastSyncTime = metav1.Now()
+		if updateErr := r.Status().Update(ctx, aggregator); updateErr != nil {
+			log.Error(updateErr, "updating status")
+			if err == nil {
+				err = updateErr
+			}
+		}
+	}
+	return
+}
+
+// collect reads all selected configmaps and merges their data prefixing keys with the namespace.
+// Namespaces are selected as replicas select them
+func (r *ConfigMapAggregatorReconciler) collect(ctx context.Context, aggregator *replicav1alpha1.ConfigMapAggregator) (data map[string]string, sources []replicav1alpha1.ConfigMapReference, conflicts []string, err error) {
+	spec := &aggregator.Spec
+	namespaces, err := replicav1alpha1.MatchingNamespaces(ctx, r, spec.NamespaceSelector, spec.AllNamespaces, spec.Namespaces, r.ProtectedNamespaces)
+	if err != nil {
+		return
+	}
+
+	data = map[string]string{}
+	target := aggregator.Spec.Target
+	for _, ns := range namespaces {
+		list := &corev1.ConfigMapList{}
+		if err = r.List(ctx, list, client.InNamespace(ns.Name), client.MatchingLabels(aggregator.Spec.Selector)); err != nil {
+			return
+		}
+		// deterministic order so the same key always comes from the same configmap
+		sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Name < list.Items[j].Name })
+		for _, cm := range list.Items {
+			if cm.Namespace == target.Namespace && cm.Name == target.Name {
+				continue
+			}
+			sources = append(sources, replicav1alpha1.ConfigMapReference{Namespace: cm.Namespace, Name: cm.Name})
+			for k, v := range cm.Data {
+				key := aggregatedKey(cm.Namespace, k)
+				if _, ok := data[key]; ok {
+					conflicts = append(conflicts, key)
+					continue
+				}
+				data[key] = v
+			}
+		}
+	}
+	sort.Strings(conflicts)
+	return
+}
+
+// aggregatedKey key in the target for a source key
+func aggregatedKey(namespace, key string) string {
+	return namespace + "." + key
+}
+
+// protectedTarget returns why the target may not be written, empty when it may. Like replicas,
+// aggregators only write to a protected namespace when a ReplicationPolicy allows it
+func (r *ConfigMapAggregatorReconciler) protectedTarget(ctx context.Context, aggregator *replicav1alpha1.ConfigMapAggregator) (string, error) {
+	namespace := aggregator.Spec.Target.Namespace
+	if !containsString(r.ProtectedNamespaces, namespace) {
+		return "", nil
+	}
+	policies, err := matchingPolicies(ctx, r, aggregator)
+	if err != nil || allowsProtected(policies, namespace) {
+		return "", err
+	}
+	return fmt.Sprintf("namespace %s is protected and no ReplicationPolicy allows it", namespace), nil
+}
+
+// syncTarget creates or updates the target configmap with the collected data
+func (r *ConfigMapAggregatorReconciler) syncTarget(ctx context.Context, log logr.Logger, aggregator *replicav1alpha1.ConfigMapAggregator, data map[string]string) error {
+	target := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: aggregator.Spec.Target.Namespace,
+			Name:      aggregator.Spec.Target.Name,
+		},
+	}
+	op, err := controllerutil.CreateOrUpdate(ctx, r.Client, target, func() error {
+		if !target.CreationTimestamp.IsZero() && !metav1.IsControlledBy(target, aggregator) {
+			return fmt.Errorf("configmap %s/%s exists and is not managed by this aggregator", target.Namespace, target.Name)
+		}
+		target.Data = data
+		return controllerutil.SetControllerReference(aggregator, target, r.Scheme)
+	})
+	if op != controllerutil.OperationResultNone {
+		log.Info("synced target", "configmap", target.ObjectMeta, "operation", op)
+	}
+	return err
+}
+
+// configMapToAggregators enqueues the aggregators selecting a configmap
+// or having it as target
+func (r *ConfigMapAggregatorReconciler) configMapToAggregators(obj handler.MapObject) []reconcile.Request {
+	list := &replicav1alpha1.ConfigMapAggregatorList{}
+	if err := r.List(context.Background(), list); err != nil {
+		r.Log.Error(err, "listing configmapaggregators", "configmap", obj.Meta.GetName())
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, item := range list.Items {
+		target := item.Spec.Target
+		if labels.SelectorFromSet(item.Spec.Selector).Matches(labels.Set(obj.Meta.GetLabels())) ||
+			(target.Namespace == obj.Meta.GetNamespace() && target.Name == obj.Meta.GetName()) {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: item.Name}})
+		}
+	}
+	return requests
+}
+
+// allAggregators enqueues all ConfigMapAggregators when a namespace or ReplicationPolicy changes
+func (r *ConfigMapAggregatorReconciler) allAggregators(obj handler.MapObject) []reconcile.Request {
+	list := &replicav1alpha1.ConfigMapAggregatorList{}
+	if err := r.List(context.Background(), list); err != nil {
+		r.Log.Error(err, "listing configmapaggregators", "namespace", obj.Meta.GetName())
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(list.Items))
+	for _, item := range list.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: item.Name}})
+	}
+	return requests
+}
+
+func (r *ConfigMapAggregatorReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.Client = mgr.GetClient()
+	r.Scheme = mgr.GetScheme()
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&replicav1alpha1.ConfigMapAggregator{}).
+		Watches(&source.Kind{Type: &corev1.ConfigMap{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(r.configMapToAggregators),
+		}).
+		Watches(&source.Kind{Type: &corev1.Namespace{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(r.allAggregators),
+		}).
+		Watches(&source.Kind{Type: &replicav1alpha1.ReplicationPolicy{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(r.allAggregators),
+		}).
+		Complete(r)
+}
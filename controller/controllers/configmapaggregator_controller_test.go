@@ -0,0 +1,212 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	replicav1alpha1 "github.com/danielfbm/k8s-design-workshop/controller/api/v1alpha1"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	mgr "sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+var _ = Describe("ConfigMapAggregator.Reconcile", func() {
+
+	var (
+		input, result *replicav1alpha1.ConfigMapAggregator
+		namespaces    []*corev1.Namespace
+		configmaps    []*corev1.ConfigMap
+		// number of sources to be expected
+		expectedSourceNumber int
+		manager              ctrl.Manager
+		controller           *ConfigMapAggregatorReconciler
+		opts                 mgr.Options
+		ctx                  context.Context
+		k8sclient            client.Client
+		err                  error
+		stop                 chan struct{}
+	)
+
+	BeforeEach(func() {
+		k8sclient = k8sClient
+		stop = make(chan struct{})
+		ctx = context.TODO()
+		namespaces = []*corev1.Namespace{}
+		configmaps = []*corev1.ConfigMap{}
+
+		manager, err = ctrl.NewManager(cfg, opts)
+		Expect(err).ToNot(HaveOccurred(), "building manager")
+		go func() {
+			Expect(manager.Start(stop)).ToNot(HaveOccurred(), "starting manager")
+		}()
+
+		controller = &ConfigMapAggregatorReconciler{Log: logf.Log}
+		Expect(controller.SetupWithManager(manager)).To(Succeed(), "starting controller")
+	})
+
+	JustBeforeEach(func() {
+		for _, ns := range namespaces {
+			Expect(k8sclient.Create(ctx, ns)).To(Succeed(), "should create ns %s", ns.Name)
+		}
+		for _, cm := range configmaps {
+			Expect(k8sclient.Create(ctx, cm)).To(Succeed(), "should create configmap %s/%s", cm.Namespace, cm.Name)
+		}
+
+		Expect(k8sclient.Create(ctx, input)).To(Succeed(), "should create a configmapaggregator %s", input)
+
+		result = &replicav1alpha1.ConfigMapAggregator{}
+		objKey := client.ObjectKey{Name: input.Name}
+		Eventually(func() int {
+			err = k8sclient.Get(ctx, objKey, result)
+			if err != nil {
+				return -1
+			}
+			return len(result.Status.Sources)
+		},
+			time.Second,
+		).Should(Equal(expectedSourceNumber), "should have %d sources", expectedSourceNumber)
+	})
+
+	AfterEach(func() {
+		k8sclient.Delete(ctx, input)
+		close(stop)
+	})
+
+	Context("two namespaces publishing service discovery snippets", func() {
+		BeforeEach(func() {
+			for _, name := range []string{"discovery-a", "discovery-b", "discovery-gateway"} {
+				namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+					Name:   name,
+					Labels: map[string]string{"discovery": "true"},
+				}})
+			}
+			configmaps = append(configmaps,
+				&corev1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "discovery-a", Name: "snippet", Labels: map[string]string{"snippet": "true"}},
+					Data:       map[string]string{"upstream.conf": "server a;"},
+				},
+				&corev1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "discovery-b", Name: "snippet", Labels: map[string]string{"snippet": "true"}},
+					Data:       map[string]string{"upstream.conf": "server b;"},
+				},
+				&corev1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "discovery-b", Name: "other"},
+					Data:       map[string]string{"ignored": "not selected"},
+				},
+			)
+
+			input = &replicav1alpha1.ConfigMapAggregator{
+				ObjectMeta: metav1.ObjectMeta{Name: "aggregator"},
+				Spec: replicav1alpha1.ConfigMapAggregatorSpec{
+					NamespaceSelector: map[string]string{"discovery": "true"},
+					Selector:          map[string]string{"snippet": "true"},
+					Target:            replicav1alpha1.ConfigMapReference{Namespace: "discovery-gateway", Name: "upstreams"},
+				},
+			}
+			expectedSourceNumber = 2
+		})
+
+		It("should merge the keys prefixed by namespace", func() {
+			Expect(result.Status.Ready).To(BeTrue())
+
+			target := &corev1.ConfigMap{}
+			Expect(k8sclient.Get(ctx, client.ObjectKey{Namespace: "discovery-gateway", Name: "upstreams"}, target)).To(Succeed())
+			Expect(target.Data).To(Equal(map[string]string{
+				"discovery-a.upstream.conf": "server a;",
+				"discovery-b.upstream.conf": "server b;",
+			}))
+		})
+	})
+
+	Context("a protected namespace matching the namespace selector", func() {
+		BeforeEach(func() {
+			controller.ProtectedNamespaces = []string{"collect-protected"}
+			for _, name := range []string{"collect-plain", "collect-protected"} {
+				namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+					Name:   name,
+					Labels: map[string]string{"collect": "protected"},
+				}})
+				configmaps = append(configmaps, &corev1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{Namespace: name, Name: "settings", Labels: map[string]string{"settings": "true"}},
+					Data:       map[string]string{"token": name},
+				})
+			}
+
+			input = &replicav1alpha1.ConfigMapAggregator{
+				ObjectMeta: metav1.ObjectMeta{Name: "protected-aggregator"},
+				Spec: replicav1alpha1.ConfigMapAggregatorSpec{
+					NamespaceSelector: map[string]string{"collect": "protected"},
+					Selector:          map[string]string{"settings": "true"},
+					Target:            replicav1alpha1.ConfigMapReference{Namespace: "collect-plain", Name: "collected"},
+				},
+			}
+			expectedSourceNumber = 1
+		})
+
+		It("should only collect from the protected namespace when it is listed", func() {
+			Expect(result.Status.Sources).To(Equal([]replicav1alpha1.ConfigMapReference{{Namespace: "collect-plain", Name: "settings"}}))
+
+			result.Spec.Namespaces = []string{"collect-protected"}
+			Expect(k8sclient.Update(ctx, result)).To(Succeed())
+			Eventually(func() int {
+				k8sclient.Get(ctx, client.ObjectKey{Name: input.Name}, result)
+				return len(result.Status.Sources)
+			}, 5*time.Second).Should(Equal(2), "should collect from the listed namespace")
+		})
+	})
+
+	Context("a target in a protected namespace", func() {
+		BeforeEach(func() {
+			controller.ProtectedNamespaces = []string{"aggregate-protected"}
+			for _, name := range []string{"aggregate-source", "aggregate-protected"} {
+				namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}})
+			}
+			configmaps = append(configmaps, &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "aggregate-source", Name: "settings", Labels: map[string]string{"aggregate": "true"}},
+				Data:       map[string]string{"token": "source"},
+			})
+
+			input = &replicav1alpha1.ConfigMapAggregator{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   "protected-target-aggregator",
+					Labels: map[string]string{"aggregate": "protected"},
+				},
+				Spec: replicav1alpha1.ConfigMapAggregatorSpec{
+					Namespaces: []string{"aggregate-source"},
+					Selector:   map[string]string{"aggregate": "true"},
+					Target:     replicav1alpha1.ConfigMapReference{Namespace: "aggregate-protected", Name: "collected"},
+				},
+			}
+			expectedSourceNumber = 1
+		})
+
+		It("should only write the target when a policy allows the namespace", func() {
+			Eventually(func() string {
+				k8sclient.Get(ctx, client.ObjectKey{Name: input.Name}, result)
+				return result.Status.Reason
+			}, 5*time.Second).Should(Equal(replicav1alpha1.ReasonPolicyDenied))
+			Expect(result.Status.Ready).To(BeFalse())
+			targetKey := client.ObjectKey{Namespace: "aggregate-protected", Name: "collected"}
+			Expect(errors.IsNotFound(k8sclient.Get(ctx, targetKey, &corev1.ConfigMap{}))).To(BeTrue(), "should not write the target")
+
+			policy := &replicav1alpha1.ReplicationPolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: "aggregate-protected"},
+				Spec: replicav1alpha1.ReplicationPolicySpec{
+					ReplicaSelector:     &metav1.LabelSelector{MatchLabels: map[string]string{"aggregate": "protected"}},
+					ProtectedNamespaces: []string{"aggregate-protected"},
+				},
+			}
+			Expect(k8sclient.Create(ctx, policy)).To(Succeed())
+			Eventually(func() error {
+				return k8sclient.Get(ctx, targetKey, &corev1.ConfigMap{})
+			}, 5*time.Second).Should(Succeed(), "should write the target once allowed")
+			Expect(k8sclient.Delete(ctx, policy)).To(Succeed())
+		})
+	})
+})
@@ -0,0 +1,153 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	replicav1alpha1 "github.com/danielfbm/k8s-design-workshop/controller/api/v1alpha1"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	mgr "sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+var _ = Describe("ConfigMapReplica.Reconcile with remote clusters", func() {
+
+	var (
+		input, result *replicav1alpha1.ConfigMapReplica
+		// remoteEnv a second api server acting as remote cluster
+		remoteEnv    *envtest.Environment
+		remoteClient client.Client
+		secret       *corev1.Secret
+		manager      ctrl.Manager
+		controller   *ConfigMapReplicaReconciler
+		opts         mgr.Options
+		ctx          context.Context
+		k8sclient    client.Client
+		err          error
+		stop         chan struct{}
+	)
+
+	BeforeEach(func() {
+		k8sclient = k8sClient
+		stop = make(chan struct{})
+		ctx = context.TODO()
+
+		By("bootstrapping the remote cluster")
+		remoteEnv = &envtest.Environment{}
+		remoteCfg, err := remoteEnv.Start()
+		Expect(err).ToNot(HaveOccurred())
+		remoteClient, err = client.New(remoteCfg, client.Options{Scheme: scheme.Scheme})
+		Expect(err).ToNot(HaveOccurred())
+
+		kubeconfig := clientcmdapi.NewConfig()
+		kubeconfig.Clusters["remote"] = &clientcmdapi.Cluster{Server: remoteCfg.Host}
+		kubeconfig.Contexts["remote"] = &clientcmdapi.Context{Cluster: "remote"}
+		kubeconfig.CurrentContext = "remote"
+		data, err := clientcmd.Write(*kubeconfig)
+		Expect(err).ToNot(HaveOccurred())
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "remote-kubeconfig"},
+			Data:       map[string][]byte{"kubeconfig": data},
+		}
+
+		manager, err = ctrl.NewManager(cfg, opts)
+		Expect(err).ToNot(HaveOccurred(), "building manager")
+		go func() {
+			Expect(manager.Start(stop)).ToNot(HaveOccurred(), "starting manager")
+		}()
+
+		controller = &ConfigMapReplicaReconciler{Log: logf.Log}
+		Expect(controller.SetupWithManager(manager)).To(Succeed(), "starting controller")
+
+		input = &replicav1alpha1.ConfigMapReplica{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "multicluster",
+				// the test api server allows every access review of a known user
+				Annotations: map[string]string{replicav1alpha1.AuthorAnnotation: "cluster-admin"},
+			},
+			Spec: replicav1alpha1.ConfigMapReplicaSpec{
+				Template: replicav1alpha1.ConfigMapTemplate{
+					Data: map[string]string{"data.yaml": "some value for configmap"},
+				},
+				Selector: map[string]string{"remote": "true"},
+				Clusters: []replicav1alpha1.ClusterReference{
+					{Name: "remote", SecretRef: replicav1alpha1.SecretKeyReference{Namespace: "default", Name: "remote-kubeconfig"}},
+					{Name: "unreachable", SecretRef: replicav1alpha1.SecretKeyReference{Namespace: "default", Name: "does-not-exist"}},
+				},
+			},
+		}
+	})
+
+	JustBeforeEach(func() {
+		Expect(remoteClient.Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:   "remote-target",
+			Labels: map[string]string{"remote": "true"},
+		}})).To(Succeed(), "should create namespace in the remote cluster")
+		Expect(k8sclient.Create(ctx, secret)).To(Succeed(), "should create kubeconfig secret")
+		Expect(k8sclient.Create(ctx, input)).To(Succeed(), "should create a configmapreplica %s", input)
+
+		result = &replicav1alpha1.ConfigMapReplica{}
+		Eventually(func() int {
+			err = k8sclient.Get(ctx, client.ObjectKey{Name: input.Name}, result)
+			if err != nil {
+				return -1
+			}
+			return len(result.Status.ConfigMapStatuses)
+		},
+			// building a client for the unreachable cluster takes a few attempts
+			10*time.Second,
+		).Should(Equal(2), "should have one status per cluster")
+	})
+
+	AfterEach(func() {
+		k8sclient.Delete(ctx, input)
+		k8sclient.Delete(ctx, secret)
+		close(stop)
+		Expect(remoteEnv.Stop()).To(Succeed())
+	})
+
+	It("should copy to the remote cluster and report the unreachable one", func() {
+		copy := &corev1.ConfigMap{}
+		Expect(remoteClient.Get(ctx, client.ObjectKey{Namespace: "remote-target", Name: input.Name}, copy)).To(Succeed(), "should copy to the remote cluster")
+		Expect(copy.Data).To(Equal(input.Spec.Template.Data))
+		Expect(copy.OwnerReferences).To(BeEmpty(), "remote copies cannot have owner references")
+
+		for _, status := range result.Status.ConfigMapStatuses {
+			switch status.Cluster {
+			case "remote":
+				Expect(status.Ready).To(BeTrue())
+				Expect(status.Namespace).To(Equal("remote-target"))
+			case "unreachable":
+				Expect(status.Ready).To(BeFalse())
+				Expect(status.Reason).To(Equal(replicav1alpha1.ReasonClusterUnreachable))
+			default:
+				Fail("unexpected status for cluster " + status.Cluster)
+			}
+		}
+	})
+
+	Context("an author who may not read the kubeconfig secret", func() {
+		BeforeEach(func() {
+			input.Annotations = nil
+		})
+
+		It("should not use the kubeconfig", func() {
+			for _, status := range result.Status.ConfigMapStatuses {
+				Expect(status.Ready).To(BeFalse())
+				Expect(status.Reason).To(Equal(replicav1alpha1.ReasonForbidden), "cluster %s", status.Cluster)
+				Expect(status.Message).To(HavePrefix("kubeconfig: "))
+			}
+			err := remoteClient.Get(ctx, client.ObjectKey{Namespace: "remote-target", Name: input.Name}, &corev1.ConfigMap{})
+			Expect(err).To(HaveOccurred(), "should not copy to the remote cluster")
+		})
+	})
+})
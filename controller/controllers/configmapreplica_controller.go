@@ -4,17 +4,18 @@ import (
 	"context"
 
 	"github.com/go-logr/logr"
-	"k8s.io/apimachinery/pkg/runtime"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"k8s.io/apimachinery/pkg/labels"
-	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	replicav1alpha1 "github.com/danielfbm/k8s-design-workshop/controller/api/v1alpha1"
-	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
 
 // ConfigMapReplicaReconciler reconciles a ConfigMapReplica object
@@ -22,10 +23,38 @@ type ConfigMapReplicaReconciler struct {
 	client.Client
 	Log    logr.Logger
 	Scheme *runtime.Scheme
+
+	// CheckAccess only writes copies to namespaces where the author or
+	// service account of the replica may create and update ConfigMaps
+	CheckAccess bool
+
+	// ProtectedNamespaces namespaces only written to when a replica lists them
+	// in spec.namespaces and a ReplicationPolicy allows it
+	ProtectedNamespaces []string
+
+	// MaxChanges copies a single sync may create, update or delete before it
+	// needs approval. Replicas can only lower it, 0 means no limit
+	MaxChanges int
+
+	// ClusterQuota limits the copies of all replicas together, nil means no limit
+	ClusterQuota *replicav1alpha1.ReplicaQuota
+
+	// RevisionNamespace namespace the template revisions of replicas are stored in,
+	// defaults to the default namespace
+	RevisionNamespace string
+
+	// clusters clients for remote clusters
+	clusters *clusterCache
+	// sources last good documents of replica sources
+	sources *httpSources
+	// secrets reads decryption keys without caching Secrets in the manager
+	secrets client.Reader
 }
 
 // +kubebuilder:rbac:groups=replica.example.com,resources=configmapreplicas,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=replica.example.com,resources=configmapreplicas/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
 
 func (r *ConfigMapReplicaReconciler) Reconcile(req ctrl.Request) (result ctrl.Result, err error) {
 	ctx := context.Background()
@@ -36,74 +65,100 @@ func (r *ConfigMapReplicaReconciler) Reconcile(req ctrl.Request) (result ctrl.Re
 		// not found error can be ignore, for all others we return
 		// it means the object was delete before the reconcile loop started
 		if errors.IsNotFound(err) {
+			r.sources.forget(req.NamespacedName)
 			err = nil
 		}
 		return
 	}
 
-	// build selector from labels in spec
-	selector := labels.SelectorFromSet(configMapReplica.Spec.Selector)
-	namespaceList := &corev1.NamespaceList{}
-	if err = r.List(ctx, namespaceList, &client.ListOptions{LabelSelector: selector}); err != nil {
-		// log.Error("error listing namespace", "err", err)
-		log.Error(err, "selector", selector)
-		return
-	}
-
-	// base data for syncing
-	baseConfigmap := &corev1.ConfigMap{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: configMapReplica.Name,
-			Labels: configMapReplica.Spec.Template.Labels,
-		},
-		Data: configMapReplica.Spec.Template.Data,
-	}
 	// making it editable
 	configMapReplica = configMapReplica.DeepCopy()
-	if configMapReplica.Status.ConfigMapStatuses == nil {
-		configMapReplica.Status.ConfigMapStatuses = []replicav1alpha1.ConfigMapReplicaCopy{}
-	}
-	if err = controllerutil.SetControllerReference(configMapReplica, baseConfigmap, r.Scheme); err != nil {
-		log.Error(err, "base", baseConfigmap, "owner", configMapReplica)
-		return
+
+	rep := &replication{
+		Client:     r.Client,
+		scheme:     r.Scheme,
+		log:        log,
+		owner:      configMapReplica,
+		spec:       &configMapReplica.Spec,
+		status:     &configMapReplica.Status,
+		controller: true,
+		remotes:    r.clusters.clusters(ctx, r.Client, newAccessReview(configMapReplica, &configMapReplica.Spec), configMapReplica.Spec.Clusters),
 	}
+	result.RequeueAfter, err = rep.reconcile(ctx, req.NamespacedName, configMapReplica, reconcileOptions{
+		checkAccess:       r.CheckAccess,
+		protected:         r.ProtectedNamespaces,
+		maxChanges:        r.MaxChanges,
+		clusterQuota:      r.ClusterQuota,
+		revisionNamespace: r.revisionNamespace(),
+		sources:           r.sources,
+		secrets:           r.secrets,
+	})
+	return
+}
 
-	for _, ns := range namespaceList.Items {
-		clone := baseConfigmap.DeepCopy()
-		clone.Namespace = ns.Name
-
-		current := &corev1.ConfigMap{}
-		key := types.NamespacedName{Namespace: ns.Name, Name: clone.Name}
-		err = r.Get(ctx, key, current)
-		switch {
-			// no item, we can create
-		case errors.IsNotFound(err):
-			log.Info("will create configmap", "configmap", clone.ObjectMeta)
-			err = r.Create(ctx, clone)
-			configMapReplica.Status.ConfigMapStatuses = append(configMapReplica.Status.ConfigMapStatuses, replicav1alpha1.ConfigMapReplicaCopy{
-				Name: clone.Name,
-				Namespace: clone.Namespace,
-				Ready: err == nil,
-				LastTransitionTime: metav1.Now(),
-				LastProbeTime: metav1.Now(),
-			})
-
-			// item exist. Should we update?
-		case  err == nil:
-			// TODO: add update
+// allReplicas enqueues all ConfigMapReplicas, used when a namespace or
+// a ReplicationPolicy changes because any replica may be affected
+func (r *ConfigMapReplicaReconciler) allReplicas(obj handler.MapObject) []reconcile.Request {
+	list := &replicav1alpha1.ConfigMapReplicaList{}
+	if err := r.List(context.Background(), list); err != nil {
+		r.Log.Error(err, "listing configmapreplicas", "trigger", obj.Meta.GetName())
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(list.Items))
+	for _, item := range list.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: item.Name}})
+	}
+	return requests
+}
 
+// consumerToReplica enqueues the replicas managing the copies a workload references
+func (r *ConfigMapReplicaReconciler) consumerToReplica(obj handler.MapObject) []reconcile.Request {
+	owners := copyOwners(r.Client, obj)
+	if len(owners) == 0 {
+		return nil
+	}
+	list := &replicav1alpha1.ConfigMapReplicaList{}
+	if err := r.List(context.Background(), list); err != nil {
+		r.Log.Error(err, "listing configmapreplicas", "consumer", obj.Meta.GetName())
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, item := range list.Items {
+		if owners[string(item.UID)] {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: item.Name}})
 		}
 	}
-
-	err = r.Update(ctx, configMapReplica)
-	log.Info("update?", "err", err)
-	return
+	return requests
 }
 
 func (r *ConfigMapReplicaReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	r.Client = mgr.GetClient()
 	r.Scheme = mgr.GetScheme()
-	return ctrl.NewControllerManagedBy(mgr).
+	r.clusters = newClusterCache(mgr.GetAPIReader(), r.Scheme)
+	r.sources = newHTTPSources(mgr.GetAPIReader())
+	r.secrets = mgr.GetAPIReader()
+	if err := indexConsumers(mgr); err != nil {
+		return err
+	}
+	builder := ctrl.NewControllerManagedBy(mgr).
 		For(&replicav1alpha1.ConfigMapReplica{}).
-		Complete(r)
+		Owns(&corev1.ConfigMap{}).
+		Watches(&source.Kind{Type: &corev1.Namespace{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(r.allReplicas),
+		}).
+		Watches(&source.Kind{Type: &replicav1alpha1.ReplicationPolicy{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(r.allReplicas),
+		})
+	for _, kind := range consumerKinds() {
+		builder = builder.Watches(&source.Kind{Type: kind}, consumerEvents(r.consumerToReplica))
+	}
+	return builder.Complete(r)
+}
+
+// revisionNamespace namespace template revisions are stored in
+func (r *ConfigMapReplicaReconciler) revisionNamespace() string {
+	if r.RevisionNamespace == "" {
+		return metav1.NamespaceDefault
+	}
+	return r.RevisionNamespace
 }
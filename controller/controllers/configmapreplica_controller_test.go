@@ -1,18 +1,35 @@
 package controllers
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"strings"
+	"net/http"
+	"regexp"
+	"net/http/httptest"
+	"sync/atomic"
 	replicav1alpha1 "github.com/danielfbm/k8s-design-workshop/controller/api/v1alpha1"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/rest"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	mgr "sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
 )
 
 var _ = Describe("ConfigMapReplica.Reconcile", func() {
@@ -22,6 +39,10 @@ var _ = Describe("ConfigMapReplica.Reconcile", func() {
 		input, result *replicav1alpha1.ConfigMapReplica
 		// namespaces to create
 		namespaces []*corev1.Namespace
+		// policies to create
+		policies []*replicav1alpha1.ReplicationPolicy
+		// configmaps existing before the replica is created
+		configmaps []*corev1.ConfigMap
 		// number of configmaps to be expected
 		expectedConfigmapNumber int
 		manager                 ctrl.Manager
@@ -43,6 +64,8 @@ var _ = Describe("ConfigMapReplica.Reconcile", func() {
 		stop = make(chan struct{})
 		ctx = context.TODO()
 		namespaces = []*corev1.Namespace{}
+		policies = []*replicav1alpha1.ReplicationPolicy{}
+		configmaps = []*corev1.ConfigMap{}
 
 		// Create and start manager
 		manager, err = ctrl.NewManager(config, opts)
@@ -51,9 +74,8 @@ var _ = Describe("ConfigMapReplica.Reconcile", func() {
 			Expect(manager.Start(stop)).ToNot(HaveOccurred(), "starting manager")
 		}()
 
-		// Create and start controller
+		// Create controller, contexts may configure it before it is started
 		controller = &ConfigMapReplicaReconciler{Log: logf.Log}
-		Expect(controller.SetupWithManager(manager)).To(Succeed(), "starting controller")
 
 		// this input data is invalid on purpose, it should be added using a specific
 		// context and valid test case
@@ -61,11 +83,20 @@ var _ = Describe("ConfigMapReplica.Reconcile", func() {
 	})
 
 	JustBeforeEach(func() {
+		// start controller
+		Expect(controller.SetupWithManager(manager)).To(Succeed(), "starting controller")
+
 		// initialize namespaces
 		// if necessary add all needed namespaces
 		for _, ns := range namespaces {
 			Expect(k8sclient.Create(ctx, ns)).To(Succeed(), "should create ns %s", ns.Name)
 		}
+		for _, policy := range policies {
+			Expect(k8sclient.Create(ctx, policy)).To(Succeed(), "should create policy %s", policy.Name)
+		}
+		for _, cm := range configmaps {
+			Expect(k8sclient.Create(ctx, cm)).To(Succeed(), "should create configmap %s/%s", cm.Namespace, cm.Name)
+		}
 
 		// initialize input
 		Expect(k8sclient.Create(ctx, input)).To(Succeed(), "should create a configmapreplica %s", input)
@@ -91,7 +122,14 @@ var _ = Describe("ConfigMapReplica.Reconcile", func() {
 
 	// Basic cleanup code
 	AfterEach(func() {
+		// the finalizer is removed by the controller, which has to be running
 		k8sclient.Delete(ctx, input)
+		Eventually(func() bool {
+			return errors.IsNotFound(k8sclient.Get(ctx, client.ObjectKey{Name: input.Name}, &replicav1alpha1.ConfigMapReplica{}))
+		}, 5*time.Second).Should(BeTrue(), "should remove the finalizer")
+		for _, policy := range policies {
+			k8sclient.Delete(ctx, policy)
+		}
 		k8sclient.DeleteAllOf(ctx, &corev1.ConfigMap{})
 		k8sclient.DeleteAllOf(ctx, &corev1.Namespace{})
 		close(stop)
@@ -133,5 +171,1415 @@ var _ = Describe("ConfigMapReplica.Reconcile", func() {
 			Expect(result).ToNot(BeNil(), "crd should exist")
 			Expect(result.Status.ConfigMapStatuses).To(HaveLen(1), "should have 1 configmapStatus")
 		})
+
+		It("should report the namespaces a change touches on admission", func() {
+			validator := &replicav1alpha1.ReplicaValidator{Client: k8sclient}
+			changed := result.DeepCopy()
+			changed.Spec.Selector = map[string]string{"key": "other-value"}
+			old, _ := json.Marshal(result)
+			current, _ := json.Marshal(changed)
+			response := validator.Handle(ctx, admission.Request{AdmissionRequest: admissionv1beta1.AdmissionRequest{
+				Kind:      metav1.GroupVersionKind{Group: replicav1alpha1.GroupVersion.Group, Version: replicav1alpha1.GroupVersion.Version, Kind: "ConfigMapReplica"},
+				Operation: admissionv1beta1.Update,
+				OldObject: runtime.RawExtension{Raw: old},
+				Object:    runtime.RawExtension{Raw: current},
+			}})
+			Expect(response.Allowed).To(BeTrue())
+			Expect(response.Result.Message).To(Equal("change touches 1 namespaces"), "should count the namespace pruned")
+			Expect(response.AuditAnnotations).To(HaveKeyWithValue("namespaces", "1"))
+		})
+
+		It("should not count protected namespaces on admission", func() {
+			all := &corev1.NamespaceList{}
+			Expect(k8sclient.List(ctx, all)).To(Succeed())
+			var protected []string
+			for _, ns := range all.Items {
+				if ns.Name != "sample" {
+					protected = append(protected, ns.Name)
+				}
+			}
+			validator := &replicav1alpha1.ReplicaValidator{Client: k8sclient, ProtectedNamespaces: protected}
+			changed := result.DeepCopy()
+			changed.Spec.Selector = nil
+			changed.Spec.AllNamespaces = true
+			current, _ := json.Marshal(changed)
+			response := validator.Handle(ctx, admission.Request{AdmissionRequest: admissionv1beta1.AdmissionRequest{
+				Kind:      metav1.GroupVersionKind{Group: replicav1alpha1.GroupVersion.Group, Version: replicav1alpha1.GroupVersion.Version, Kind: "ConfigMapReplica"},
+				Operation: admissionv1beta1.Create,
+				Object:    runtime.RawExtension{Raw: current},
+			}})
+			Expect(response.Allowed).To(BeTrue())
+			Expect(response.AuditAnnotations).To(HaveKeyWithValue("namespaces", "1"), "should only count the unprotected namespace")
+		})
+	})
+
+	Context("replication policy restricting target namespaces", func() {
+		BeforeEach(func() {
+			namespaces = append(namespaces,
+				&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+					Name:   "policy-allowed",
+					Labels: map[string]string{"policy": "test", "allowed": "true"},
+				}},
+				&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+					Name:   "policy-denied",
+					Labels: map[string]string{"policy": "test"},
+				}},
+			)
+			policies = append(policies, &replicav1alpha1.ReplicationPolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: "only-allowed"},
+				Spec: replicav1alpha1.ReplicationPolicySpec{
+					ReplicaSelector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{"restricted": "true"},
+					},
+					TargetNamespaceSelector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{"allowed": "true"},
+					},
+				},
+			})
+
+			input = &replicav1alpha1.ConfigMapReplica{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   "restricted-replica",
+					Labels: map[string]string{"restricted": "true"},
+				},
+				Spec: replicav1alpha1.ConfigMapReplicaSpec{
+					Template: replicav1alpha1.ConfigMapTemplate{
+						Data: map[string]string{"data.yaml": "some value for configmap"},
+					},
+					Selector: map[string]string{"policy": "test"},
+				},
+			}
+			expectedConfigmapNumber = 2
+		})
+
+		It("should deny the namespace not allowed by the policy", func() {
+			Expect(k8sclient.Get(ctx, client.ObjectKey{Namespace: "policy-allowed", Name: input.Name}, &corev1.ConfigMap{})).To(Succeed(), "should copy to the allowed namespace")
+
+			for _, status := range result.Status.ConfigMapStatuses {
+				if status.Namespace == "policy-denied" {
+					Expect(status.Ready).To(BeFalse())
+					Expect(status.Reason).To(Equal(replicav1alpha1.ReasonPolicyDenied))
+					Expect(status.Message).To(ContainSubstring("only-allowed"), "should name the policy")
+				} else {
+					Expect(status.Ready).To(BeTrue())
+				}
+			}
+		})
+	})
+
+	Context("data fetched from an http source", func() {
+		var (
+			server *httptest.Server
+			// failing makes the server answer with errors
+			failing int32
+		)
+
+		BeforeEach(func() {
+			atomic.StoreInt32(&failing, 0)
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if atomic.LoadInt32(&failing) == 1 {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("ETag", `"v1"`)
+				if req.Header.Get("If-None-Match") == `"v1"` {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Write([]byte(`{"service": {"endpoint": "http://backend:8080", "replicas": 3}}`))
+			}))
+
+			namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:   "source-target",
+				Labels: map[string]string{"source": "http"},
+			}})
+			input = &replicav1alpha1.ConfigMapReplica{
+				ObjectMeta: metav1.ObjectMeta{Name: "sourced-replica"},
+				Spec: replicav1alpha1.ConfigMapReplicaSpec{
+					Template: replicav1alpha1.ConfigMapTemplate{
+						Data: map[string]string{"static": "value"},
+					},
+					Selector: map[string]string{"source": "http"},
+					Source: &replicav1alpha1.ConfigMapSource{HTTP: &replicav1alpha1.HTTPSource{
+						URL:      server.URL,
+						Interval: &metav1.Duration{Duration: time.Second},
+						KeyMapping: map[string]string{
+							"endpoint": "service.endpoint",
+							"replicas": "service.replicas",
+						},
+					}},
+				},
+			}
+			expectedConfigmapNumber = 1
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("should merge the fetched data and keep it when fetching fails", func() {
+			expected := map[string]string{"static": "value", "endpoint": "http://backend:8080", "replicas": "3"}
+			copy := &corev1.ConfigMap{}
+			Expect(k8sclient.Get(ctx, client.ObjectKey{Namespace: "source-target", Name: input.Name}, copy)).To(Succeed())
+			Expect(copy.Data).To(Equal(expected))
+
+			atomic.StoreInt32(&failing, 1)
+			Eventually(func() []replicav1alpha1.ConfigMapReplicaCondition {
+				k8sclient.Get(ctx, client.ObjectKey{Name: input.Name}, result)
+				return result.Status.Conditions
+			}, 5*time.Second).Should(ContainElement(WithTransform(func(c replicav1alpha1.ConfigMapReplicaCondition) replicav1alpha1.ConfigMapReplicaConditionType {
+				return c.Type
+			}, Equal(replicav1alpha1.ConditionSourceFetchFailed))), "should report the failed fetch")
+
+			Expect(k8sclient.Get(ctx, client.ObjectKey{Namespace: "source-target", Name: input.Name}, copy)).To(Succeed())
+			Expect(copy.Data).To(Equal(expected), "should keep the last good data")
+		})
+	})
+
+	Context("http source headers from a secret the author may not read", func() {
+		var server *httptest.Server
+
+		BeforeEach(func() {
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Write([]byte(`{"token": "` + req.Header.Get("Authorization") + `"}`))
+			}))
+			namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:   "headers-target",
+				Labels: map[string]string{"source": "headers"},
+			}})
+			Expect(k8sclient.Create(ctx, &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "headers-secret"},
+				Data:       map[string][]byte{"Authorization": []byte("Bearer secret")},
+			})).To(Succeed())
+			input = &replicav1alpha1.ConfigMapReplica{
+				ObjectMeta: metav1.ObjectMeta{Name: "headers-replica"},
+				Spec: replicav1alpha1.ConfigMapReplicaSpec{
+					Template: replicav1alpha1.ConfigMapTemplate{
+						Data: map[string]string{"static": "value"},
+					},
+					Selector: map[string]string{"source": "headers"},
+					Source: &replicav1alpha1.ConfigMapSource{HTTP: &replicav1alpha1.HTTPSource{
+						URL:               server.URL,
+						HeadersFromSecret: &replicav1alpha1.SecretReference{Namespace: "default", Name: "headers-secret"},
+					}},
+				},
+			}
+			expectedConfigmapNumber = 0
+		})
+
+		AfterEach(func() {
+			server.Close()
+			k8sclient.Delete(ctx, &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "headers-secret"}})
+		})
+
+		It("should not send the secret", func() {
+			Eventually(func() []replicav1alpha1.ConfigMapReplicaCondition {
+				k8sclient.Get(ctx, client.ObjectKey{Name: input.Name}, result)
+				return result.Status.Conditions
+			}, 5*time.Second).Should(ContainElement(WithTransform(func(c replicav1alpha1.ConfigMapReplicaCondition) string {
+				return string(c.Type) + ": " + c.Message
+			}, And(HavePrefix(string(replicav1alpha1.ConditionSourceFetchFailed)), ContainSubstring("headersFromSecret")))))
+
+			err := k8sclient.Get(ctx, client.ObjectKey{Namespace: "headers-target", Name: input.Name}, &corev1.ConfigMap{})
+			Expect(err).To(HaveOccurred(), "should not copy without the source data")
+		})
+	})
+
+	Context("http source data larger than a policy allows", func() {
+		var server *httptest.Server
+
+		BeforeEach(func() {
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Write([]byte(`{"big": "` + strings.Repeat("x", 2048) + `"}`))
+			}))
+			namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:   "limited-target",
+				Labels: map[string]string{"source": "limited"},
+			}})
+			maxSize := resource.MustParse("1Ki")
+			policies = append(policies, &replicav1alpha1.ReplicationPolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: "small-data"},
+				Spec: replicav1alpha1.ReplicationPolicySpec{
+					ReplicaSelector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{"limited": "true"},
+					},
+					MaxDataSize: &maxSize,
+				},
+			})
+			input = &replicav1alpha1.ConfigMapReplica{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   "limited-replica",
+					Labels: map[string]string{"limited": "true"},
+				},
+				Spec: replicav1alpha1.ConfigMapReplicaSpec{
+					Template: replicav1alpha1.ConfigMapTemplate{
+						Data: map[string]string{"small": "value"},
+					},
+					Selector: map[string]string{"source": "limited"},
+					Source:   &replicav1alpha1.ConfigMapSource{HTTP: &replicav1alpha1.HTTPSource{URL: server.URL}},
+				},
+			}
+			expectedConfigmapNumber = 1
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("should deny the copy", func() {
+			Expect(result.Status.ConfigMapStatuses[0].Ready).To(BeFalse())
+			Expect(result.Status.ConfigMapStatuses[0].Reason).To(Equal(replicav1alpha1.ReasonPolicyDenied))
+			Expect(result.Status.ConfigMapStatuses[0].Message).To(ContainSubstring("small-data"), "should name the policy")
+
+			err := k8sclient.Get(ctx, client.ObjectKey{Namespace: "limited-target", Name: input.Name}, &corev1.ConfigMap{})
+			Expect(err).To(HaveOccurred(), "should not copy data larger than the policy allows")
+		})
+	})
+
+	Context("http source returning an oversized document", func() {
+		var server *httptest.Server
+
+		BeforeEach(func() {
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Write([]byte(`{"big": "` + strings.Repeat("x", 1<<20) + `"}`))
+			}))
+			namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:   "oversized-target",
+				Labels: map[string]string{"source": "oversized"},
+			}})
+			input = &replicav1alpha1.ConfigMapReplica{
+				ObjectMeta: metav1.ObjectMeta{Name: "oversized-replica"},
+				Spec: replicav1alpha1.ConfigMapReplicaSpec{
+					Selector: map[string]string{"source": "oversized"},
+					Source:   &replicav1alpha1.ConfigMapSource{HTTP: &replicav1alpha1.HTTPSource{URL: server.URL}},
+				},
+			}
+			expectedConfigmapNumber = 0
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("should report a fetch error", func() {
+			Eventually(func() []replicav1alpha1.ConfigMapReplicaCondition {
+				k8sclient.Get(ctx, client.ObjectKey{Name: input.Name}, result)
+				return result.Status.Conditions
+			}, 5*time.Second).Should(ContainElement(WithTransform(func(c replicav1alpha1.ConfigMapReplicaCondition) string {
+				return c.Message
+			}, ContainSubstring("larger than"))))
+		})
+	})
+
+	Context("access checks without a recorded author", func() {
+		BeforeEach(func() {
+			controller.CheckAccess = true
+			namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:   "access-target",
+				Labels: map[string]string{"access": "checked"},
+			}})
+			input = &replicav1alpha1.ConfigMapReplica{
+				ObjectMeta: metav1.ObjectMeta{Name: "anonymous-replica"},
+				Spec: replicav1alpha1.ConfigMapReplicaSpec{
+					Template: replicav1alpha1.ConfigMapTemplate{
+						Data: map[string]string{"data.yaml": "some value for configmap"},
+					},
+					Selector: map[string]string{"access": "checked"},
+				},
+			}
+			expectedConfigmapNumber = 1
+		})
+
+		It("should forbid every namespace", func() {
+			Expect(result.Status.ConfigMapStatuses[0].Ready).To(BeFalse())
+			Expect(result.Status.ConfigMapStatuses[0].Reason).To(Equal(replicav1alpha1.ReasonForbidden))
+			Expect(result.Status.ConfigMapStatuses[0].Message).To(ContainSubstring(replicav1alpha1.AuthorAnnotation))
+
+			err := k8sclient.Get(ctx, client.ObjectKey{Namespace: "access-target", Name: input.Name}, &corev1.ConfigMap{})
+			Expect(err).To(HaveOccurred(), "should not copy to a forbidden namespace")
+		})
+	})
+
+	Context("protected namespaces", func() {
+		BeforeEach(func() {
+			controller.ProtectedNamespaces = []string{"protected-selected", "protected-listed"}
+			for _, name := range []string{"protected-plain", "protected-selected", "protected-listed"} {
+				namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+					Name:   name,
+					Labels: map[string]string{"protected": "test"},
+				}})
+			}
+			input = &replicav1alpha1.ConfigMapReplica{
+				ObjectMeta: metav1.ObjectMeta{Name: "protected-replica"},
+				Spec: replicav1alpha1.ConfigMapReplicaSpec{
+					Template: replicav1alpha1.ConfigMapTemplate{
+						Data: map[string]string{"data.yaml": "some value for configmap"},
+					},
+					Selector:   map[string]string{"protected": "test"},
+					Namespaces: []string{"protected-listed"},
+				},
+			}
+			// the selected protected namespace is skipped
+			expectedConfigmapNumber = 2
+		})
+
+		It("should only consider listed protected namespaces and deny them without a policy", func() {
+			for _, status := range result.Status.ConfigMapStatuses {
+				switch status.Namespace {
+				case "protected-plain":
+					Expect(status.Ready).To(BeTrue())
+				case "protected-listed":
+					Expect(status.Ready).To(BeFalse())
+					Expect(status.Reason).To(Equal(replicav1alpha1.ReasonPolicyDenied))
+				default:
+					Fail("unexpected status for namespace " + status.Namespace)
+				}
+			}
+		})
+	})
+
+	Context("existing configmaps with the adopt conflict policy", func() {
+		BeforeEach(func() {
+			namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:   "adopt-target",
+				Labels: map[string]string{"adopt": "test"},
+			}})
+			configmaps = append(configmaps, &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "adopt-target",
+					Name:      "adopting-replica",
+					OwnerReferences: []metav1.OwnerReference{
+						{APIVersion: "v1", Kind: "ConfigMap", Name: "adopt-owner", UID: "adopt-owner-uid"},
+					},
+				},
+				Data: map[string]string{"data.yaml": "created by hand"},
+			})
+			input = &replicav1alpha1.ConfigMapReplica{
+				ObjectMeta: metav1.ObjectMeta{Name: "adopting-replica"},
+				Spec: replicav1alpha1.ConfigMapReplicaSpec{
+					Template: replicav1alpha1.ConfigMapTemplate{
+						Data: map[string]string{"data.yaml": "some value for configmap"},
+					},
+					Selector:       map[string]string{"adopt": "test"},
+					ConflictPolicy: replicav1alpha1.ConflictPolicyAdopt,
+				},
+			}
+			expectedConfigmapNumber = 1
+		})
+
+		It("should take over the existing configmap", func() {
+			Expect(result.Status.ConfigMapStatuses[0].Ready).To(BeTrue())
+
+			copy := &corev1.ConfigMap{}
+			Expect(k8sclient.Get(ctx, client.ObjectKey{Namespace: "adopt-target", Name: input.Name}, copy)).To(Succeed())
+			Expect(copy.Data).To(Equal(input.Spec.Template.Data))
+			Expect(copy.Labels).To(HaveKeyWithValue(replicav1alpha1.OwnerUIDLabel, string(result.UID)))
+			Expect(copy.OwnerReferences).To(HaveLen(2), "should keep the other owner")
+			Expect(copy.OwnerReferences[0].Name).To(Equal("adopt-owner"))
+			Expect(metav1.IsControlledBy(copy, result)).To(BeTrue())
+		})
+	})
+
+	Context("changes exceeding the blast radius", func() {
+		BeforeEach(func() {
+			controller.MaxChanges = 1
+			for _, name := range []string{"blast-a", "blast-b"} {
+				namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+					Name:   name,
+					Labels: map[string]string{"blast": "radius"},
+				}})
+			}
+			input = &replicav1alpha1.ConfigMapReplica{
+				ObjectMeta: metav1.ObjectMeta{Name: "blast-replica"},
+				Spec: replicav1alpha1.ConfigMapReplicaSpec{
+					Template: replicav1alpha1.ConfigMapTemplate{
+						Data: map[string]string{"data.yaml": "some value for configmap"},
+					},
+					Selector: map[string]string{"blast": "radius"},
+				},
+			}
+			// nothing is written until approved
+			expectedConfigmapNumber = 0
+		})
+
+		It("should wait for approval of the planned changes before writing", func() {
+			key := client.ObjectKey{Name: input.Name}
+			// approval returns the annotation value the BlastRadiusExceeded condition asks for
+			approval := func() string {
+				k8sclient.Get(ctx, key, result)
+				for _, condition := range result.Status.Conditions {
+					if condition.Type == replicav1alpha1.ConditionBlastRadiusExceeded {
+						if match := regexp.MustCompile(`approved-generation: "([^"]+)"`).FindStringSubmatch(condition.Message); match != nil {
+							return match[1]
+						}
+					}
+				}
+				return ""
+			}
+			Eventually(approval, 5*time.Second).ShouldNot(BeEmpty(), "should report the exceeded blast radius")
+			Expect(result.Status.ConfigMapStatuses).To(BeEmpty(), "should not write any copy")
+			stale := approval()
+
+			// a new namespace changes the plan without changing the generation
+			Expect(k8sclient.Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:   "blast-c",
+				Labels: map[string]string{"blast": "radius"},
+			}})).To(Succeed())
+			Eventually(approval, 5*time.Second).ShouldNot(Equal(stale), "should ask for a new approval")
+			current := approval()
+
+			Eventually(func() error {
+				k8sclient.Get(ctx, key, result)
+				result.Annotations = map[string]string{replicav1alpha1.ApprovedGenerationAnnotation: stale}
+				return k8sclient.Update(ctx, result)
+			}, 5*time.Second).Should(Succeed(), "should approve the previous changes")
+			Consistently(func() int {
+				k8sclient.Get(ctx, key, result)
+				return len(result.Status.ConfigMapStatuses)
+			}, 2*time.Second).Should(BeZero(), "should not write with a stale approval")
+
+			Eventually(func() error {
+				k8sclient.Get(ctx, key, result)
+				result.Annotations = map[string]string{replicav1alpha1.ApprovedGenerationAnnotation: current}
+				return k8sclient.Update(ctx, result)
+			}, 5*time.Second).Should(Succeed(), "should approve the changes")
+			Eventually(func() int {
+				k8sclient.Get(ctx, key, result)
+				return len(result.Status.ConfigMapStatuses)
+			}, 5*time.Second).Should(Equal(3), "should write the copies once approved")
+			Expect(result.Status.Conditions).To(BeEmpty())
+		})
+	})
+
+	Context("copies exceeding the replica quota", func() {
+		BeforeEach(func() {
+			for _, name := range []string{"quota-a", "quota-b"} {
+				namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+					Name:   name,
+					Labels: map[string]string{"quota": "copies"},
+				}})
+			}
+			maxCopies := int32(1)
+			input = &replicav1alpha1.ConfigMapReplica{
+				ObjectMeta: metav1.ObjectMeta{Name: "quota-replica"},
+				Spec: replicav1alpha1.ConfigMapReplicaSpec{
+					Template: replicav1alpha1.ConfigMapTemplate{
+						Data: map[string]string{"data.yaml": "some value for configmap"},
+					},
+					Selector: map[string]string{"quota": "copies"},
+					Quota:    &replicav1alpha1.ReplicaQuota{MaxCopies: &maxCopies},
+				},
+			}
+			// nothing is written over quota
+			expectedConfigmapNumber = 0
+		})
+
+		It("should report the exceeded quota without writing", func() {
+			key := client.ObjectKey{Name: input.Name}
+			Eventually(func() []replicav1alpha1.ConfigMapReplicaCondition {
+				k8sclient.Get(ctx, key, result)
+				return result.Status.Conditions
+			}, 5*time.Second).Should(ContainElement(WithTransform(func(c replicav1alpha1.ConfigMapReplicaCondition) replicav1alpha1.ConfigMapReplicaConditionType {
+				return c.Type
+			}, Equal(replicav1alpha1.ConditionQuotaExceeded))), "should report the exceeded quota")
+			Expect(result.Status.ConfigMapStatuses).To(BeEmpty(), "should not write any copy")
+			Expect(result.Status.Usage).To(Equal(replicav1alpha1.ReplicaUsage{}))
+		})
+	})
+
+	Context("deleting a replica with the orphan deletion policy", func() {
+		BeforeEach(func() {
+			namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:   "orphan-target",
+				Labels: map[string]string{"deletion": "orphan"},
+			}})
+			input = &replicav1alpha1.ConfigMapReplica{
+				ObjectMeta: metav1.ObjectMeta{Name: "orphan-replica"},
+				Spec: replicav1alpha1.ConfigMapReplicaSpec{
+					Template: replicav1alpha1.ConfigMapTemplate{
+						Data:   map[string]string{"data.yaml": "some value for configmap"},
+						Labels: map[string]string{replicav1alpha1.ManagedByLabel: replicav1alpha1.ManagedByValue},
+					},
+					Selector:       map[string]string{"deletion": "orphan"},
+					DeletionPolicy: replicav1alpha1.DeletionPolicyOrphan,
+				},
+			}
+			expectedConfigmapNumber = 1
+		})
+
+		It("should keep the copy without owner reference and managed labels", func() {
+			Expect(result.Finalizers).To(ContainElement(copiesFinalizer))
+			Expect(k8sclient.Delete(ctx, result)).To(Succeed())
+			Eventually(func() bool {
+				return errors.IsNotFound(k8sclient.Get(ctx, client.ObjectKey{Name: input.Name}, result))
+			}, 5*time.Second).Should(BeTrue(), "should remove the finalizer")
+
+			copy := &corev1.ConfigMap{}
+			Expect(k8sclient.Get(ctx, client.ObjectKey{Namespace: "orphan-target", Name: input.Name}, copy)).To(Succeed())
+			Expect(copy.Data).To(Equal(input.Spec.Template.Data))
+			Expect(copy.OwnerReferences).To(BeEmpty())
+			Expect(copy.Labels).ToNot(HaveKey(replicav1alpha1.OwnerUIDLabel))
+			Expect(copy.Labels).ToNot(HaveKey(replicav1alpha1.ManagedByLabel))
+		})
+	})
+
+	Context("deleting a replica with the retain deletion policy", func() {
+		BeforeEach(func() {
+			namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:   "retain-target",
+				Labels: map[string]string{"deletion": "retain"},
+			}})
+			input = &replicav1alpha1.ConfigMapReplica{
+				ObjectMeta: metav1.ObjectMeta{Name: "retain-replica"},
+				Spec: replicav1alpha1.ConfigMapReplicaSpec{
+					Template: replicav1alpha1.ConfigMapTemplate{
+						Data: map[string]string{"data.yaml": "some value for configmap"},
+					},
+					Selector:       map[string]string{"deletion": "retain"},
+					DeletionPolicy: replicav1alpha1.DeletionPolicyRetain,
+				},
+			}
+			expectedConfigmapNumber = 1
+		})
+
+		It("should let the retained copy be edited", func() {
+			protector := &replicav1alpha1.CopyProtector{Client: k8sclient}
+			copy := &corev1.ConfigMap{}
+			Expect(k8sclient.Get(ctx, client.ObjectKey{Namespace: "retain-target", Name: input.Name}, copy)).To(Succeed())
+			edit := func() admission.Response {
+				edited := copy.DeepCopy()
+				edited.Data = map[string]string{"data.yaml": "edited by hand"}
+				old, _ := json.Marshal(copy)
+				current, _ := json.Marshal(edited)
+				return protector.Handle(ctx, admission.Request{AdmissionRequest: admissionv1beta1.AdmissionRequest{
+					Operation: admissionv1beta1.Update,
+					UserInfo:  authenticationv1.UserInfo{Username: "someone"},
+					OldObject: runtime.RawExtension{Raw: old},
+					Object:    runtime.RawExtension{Raw: current},
+				}})
+			}
+			Expect(edit().Allowed).To(BeFalse(), "should protect the copy of an existing replica")
+
+			Expect(k8sclient.Delete(ctx, result)).To(Succeed())
+			Eventually(func() bool {
+				return errors.IsNotFound(k8sclient.Get(ctx, client.ObjectKey{Name: input.Name}, result))
+			}, 5*time.Second).Should(BeTrue(), "should remove the finalizer")
+
+			Expect(k8sclient.Get(ctx, client.ObjectKey{Namespace: "retain-target", Name: input.Name}, copy)).To(Succeed())
+			Expect(copy.Labels).To(HaveKey(replicav1alpha1.OwnerUIDLabel))
+			Expect(edit().Allowed).To(BeTrue(), "should allow editing once the replica is gone")
+		})
+	})
+
+	Context("pruning a copy still used by a deployment", func() {
+		BeforeEach(func() {
+			namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:   "consumer-target",
+				Labels: map[string]string{"consumer": "deployment"},
+			}})
+			input = &replicav1alpha1.ConfigMapReplica{
+				ObjectMeta: metav1.ObjectMeta{Name: "consumer-replica"},
+				Spec: replicav1alpha1.ConfigMapReplicaSpec{
+					Template: replicav1alpha1.ConfigMapTemplate{
+						Data: map[string]string{"data.yaml": "some value for configmap"},
+					},
+					Selector: map[string]string{"consumer": "deployment"},
+				},
+			}
+			expectedConfigmapNumber = 1
+		})
+
+		It("should defer the deletion until forced", func() {
+			labels := map[string]string{"app": "consumer"}
+			deployment := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "consumer-target", Name: "consumer"},
+				Spec: appsv1.DeploymentSpec{
+					Selector: &metav1.LabelSelector{MatchLabels: labels},
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{Labels: labels},
+						Spec: corev1.PodSpec{Containers: []corev1.Container{{
+							Name:  "app",
+							Image: "app",
+							EnvFrom: []corev1.EnvFromSource{{ConfigMapRef: &corev1.ConfigMapEnvSource{
+								LocalObjectReference: corev1.LocalObjectReference{Name: input.Name},
+							}}},
+						}}},
+					},
+				},
+			}
+			Expect(k8sclient.Create(ctx, deployment)).To(Succeed())
+
+			key := client.ObjectKey{Name: input.Name}
+			result.Spec.Selector = map[string]string{"consumer": "none"}
+			Expect(k8sclient.Update(ctx, result)).To(Succeed(), "should stop targeting the namespace")
+			Eventually(func() string {
+				k8sclient.Get(ctx, key, result)
+				if len(result.Status.ConfigMapStatuses) != 1 {
+					return ""
+				}
+				return result.Status.ConfigMapStatuses[0].Reason
+			}, 5*time.Second).Should(Equal(replicav1alpha1.ReasonInUse), "should report the copy in use")
+			Expect(result.Status.ConfigMapStatuses[0].Message).To(ContainSubstring("Deployment/consumer"))
+			copy := &corev1.ConfigMap{}
+			Expect(k8sclient.Get(ctx, client.ObjectKey{Namespace: "consumer-target", Name: input.Name}, copy)).To(Succeed(), "should keep the copy")
+
+			result.Annotations = map[string]string{replicav1alpha1.ForcePruneAnnotation: "true"}
+			Expect(k8sclient.Update(ctx, result)).To(Succeed(), "should force the deletion")
+			Eventually(func() bool {
+				return errors.IsNotFound(k8sclient.Get(ctx, client.ObjectKey{Namespace: "consumer-target", Name: input.Name}, copy))
+			}, 5*time.Second).Should(BeTrue(), "should delete the copy")
+			Expect(k8sclient.Delete(ctx, deployment)).To(Succeed())
+		})
+	})
+
+	Context("template changes with a staged rollout", func() {
+		BeforeEach(func() {
+			for _, stage := range []string{"dev", "prod"} {
+				namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+					Name:   "rollout-" + stage,
+					Labels: map[string]string{"rollout": "staged", "stage": stage},
+				}})
+			}
+			input = &replicav1alpha1.ConfigMapReplica{
+				ObjectMeta: metav1.ObjectMeta{Name: "rollout-replica"},
+				Spec: replicav1alpha1.ConfigMapReplicaSpec{
+					Template: replicav1alpha1.ConfigMapTemplate{
+						Data: map[string]string{"data.yaml": "first value"},
+					},
+					Selector: map[string]string{"rollout": "staged"},
+					RolloutStrategy: &replicav1alpha1.RolloutStrategy{Waves: []replicav1alpha1.RolloutWave{
+						{Name: "dev", Selector: map[string]string{"stage": "dev"}},
+						{Name: "prod", Selector: map[string]string{"stage": "prod"}, ManualPromotion: true},
+					}},
+				},
+			}
+			expectedConfigmapNumber = 2
+		})
+
+		It("should update the prod wave once promoted", func() {
+			copyData := func(namespace string) string {
+				copy := &corev1.ConfigMap{}
+				k8sclient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: input.Name}, copy)
+				return copy.Data["data.yaml"]
+			}
+			key := client.ObjectKey{Name: input.Name}
+			result.Spec.Template.Data = map[string]string{"data.yaml": "second value"}
+			Expect(k8sclient.Update(ctx, result)).To(Succeed(), "should change the template")
+
+			Eventually(func() string { return copyData("rollout-dev") }, 5*time.Second).Should(Equal("second value"), "should update the first wave")
+			Eventually(func() string {
+				k8sclient.Get(ctx, key, result)
+				if result.Status.Rollout == nil {
+					return ""
+				}
+				return result.Status.Rollout.Wave
+			}, 5*time.Second).Should(Equal("prod"), "should wait in the prod wave")
+			Expect(copyData("rollout-prod")).To(Equal("first value"), "should hold the prod wave")
+
+			result.Annotations = map[string]string{replicav1alpha1.PromotedWaveAnnotation: "prod@" + result.Status.Rollout.Revision}
+			Expect(k8sclient.Update(ctx, result)).To(Succeed(), "should promote the prod wave")
+			Eventually(func() string { return copyData("rollout-prod") }, 5*time.Second).Should(Equal("second value"), "should update the promoted wave")
+		})
+	})
+
+	Context("a canary rollout with an unavailable consumer", func() {
+		BeforeEach(func() {
+			for _, stage := range []string{"canary", "stable"} {
+				namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+					Name:   "verify-" + stage,
+					Labels: map[string]string{"rollout": "verified", "stage": stage},
+				}})
+			}
+			input = &replicav1alpha1.ConfigMapReplica{
+				ObjectMeta: metav1.ObjectMeta{Name: "verify-replica"},
+				Spec: replicav1alpha1.ConfigMapReplicaSpec{
+					Template: replicav1alpha1.ConfigMapTemplate{
+						Data: map[string]string{"data.yaml": "first value"},
+					},
+					Selector: map[string]string{"rollout": "verified"},
+					RolloutStrategy: &replicav1alpha1.RolloutStrategy{
+						Waves: []replicav1alpha1.RolloutWave{
+							{Name: "canary", Selector: map[string]string{"stage": "canary"}},
+						},
+						Verification: &replicav1alpha1.RolloutVerification{Window: metav1.Duration{Duration: time.Minute}},
+					},
+				},
+			}
+			expectedConfigmapNumber = 2
+		})
+
+		It("should revert the canary and halt", func() {
+			labels := map[string]string{"app": "canary"}
+			deployment := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "verify-canary", Name: "canary"},
+				Spec: appsv1.DeploymentSpec{
+					Selector: &metav1.LabelSelector{MatchLabels: labels},
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{Labels: labels},
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{{Name: "app", Image: "app"}},
+							Volumes: []corev1.Volume{{Name: "config", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+								LocalObjectReference: corev1.LocalObjectReference{Name: input.Name},
+							}}}},
+						},
+					},
+				},
+			}
+			Expect(k8sclient.Create(ctx, deployment)).To(Succeed())
+			deployment.Status.Conditions = []appsv1.DeploymentCondition{{Type: appsv1.DeploymentAvailable, Status: corev1.ConditionFalse}}
+			Expect(k8sclient.Status().Update(ctx, deployment)).To(Succeed(), "should mark the consumer unavailable")
+
+			key := client.ObjectKey{Name: input.Name}
+			result.Spec.Template.Data = map[string]string{"data.yaml": "second value"}
+			Expect(k8sclient.Update(ctx, result)).To(Succeed(), "should change the template")
+			Eventually(func() []replicav1alpha1.ConfigMapReplicaCondition {
+				k8sclient.Get(ctx, key, result)
+				return result.Status.Conditions
+			}, 5*time.Second).Should(ContainElement(WithTransform(func(c replicav1alpha1.ConfigMapReplicaCondition) replicav1alpha1.ConfigMapReplicaConditionType {
+				return c.Type
+			}, Equal(replicav1alpha1.ConditionRolloutFailed))), "should fail the rollout")
+
+			for _, namespace := range []string{"verify-canary", "verify-stable"} {
+				copy := &corev1.ConfigMap{}
+				Eventually(func() string {
+					k8sclient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: input.Name}, copy)
+					return copy.Data["data.yaml"]
+				}, 5*time.Second).Should(Equal("first value"), "should keep %s on the previous revision", namespace)
+			}
+			Expect(k8sclient.Delete(ctx, deployment)).To(Succeed())
+		})
+	})
+
+	Context("a single wave rollout with an unavailable consumer", func() {
+		BeforeEach(func() {
+			namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:   "single-wave",
+				Labels: map[string]string{"rollout": "single"},
+			}})
+			input = &replicav1alpha1.ConfigMapReplica{
+				ObjectMeta: metav1.ObjectMeta{Name: "single-wave-replica"},
+				Spec: replicav1alpha1.ConfigMapReplicaSpec{
+					Template: replicav1alpha1.ConfigMapTemplate{
+						Data: map[string]string{"data.yaml": "first value"},
+					},
+					Selector: map[string]string{"rollout": "single"},
+					RolloutStrategy: &replicav1alpha1.RolloutStrategy{
+						Verification: &replicav1alpha1.RolloutVerification{Window: metav1.Duration{Duration: time.Minute}},
+					},
+				},
+			}
+			expectedConfigmapNumber = 1
+		})
+
+		It("should revert every copy from the revision history", func() {
+			deployment := unavailableConsumer(ctx, k8sclient, "single-wave", input.Name)
+			defer k8sclient.Delete(ctx, deployment)
+
+			key := client.ObjectKey{Name: input.Name}
+			result.Spec.Template.Data = map[string]string{"data.yaml": "second value"}
+			Expect(k8sclient.Update(ctx, result)).To(Succeed(), "should change the template")
+			Eventually(func() []replicav1alpha1.ConfigMapReplicaCondition {
+				k8sclient.Get(ctx, key, result)
+				return result.Status.Conditions
+			}, 5*time.Second).Should(ContainElement(WithTransform(func(c replicav1alpha1.ConfigMapReplicaCondition) string {
+				return c.Message
+			}, ContainSubstring("copies reverted to template revision 1"))), "should fail the rollout")
+
+			copy := &corev1.ConfigMap{}
+			Eventually(func() string {
+				k8sclient.Get(ctx, client.ObjectKey{Namespace: "single-wave", Name: input.Name}, copy)
+				return copy.Data["data.yaml"]
+			}, 5*time.Second).Should(Equal("first value"), "should restore the previous data")
+		})
+	})
+
+	Context("a sharded rollout with an unavailable consumer", func() {
+		BeforeEach(func() {
+			namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:   "sharded-rollout",
+				Labels: map[string]string{"rollout": "sharded"},
+			}})
+			maxShardBytes := int32(1024)
+			input = &replicav1alpha1.ConfigMapReplica{
+				ObjectMeta: metav1.ObjectMeta{Name: "sharded-rollout-replica"},
+				Spec: replicav1alpha1.ConfigMapReplicaSpec{
+					Template: replicav1alpha1.ConfigMapTemplate{
+						Data: map[string]string{"big.txt": strings.Repeat("x", 2500)},
+					},
+					Selector: map[string]string{"rollout": "sharded"},
+					Sharding: &replicav1alpha1.Sharding{MaxShardBytes: &maxShardBytes},
+					RolloutStrategy: &replicav1alpha1.RolloutStrategy{
+						Verification: &replicav1alpha1.RolloutVerification{Window: metav1.Duration{Duration: time.Minute}},
+					},
+				},
+			}
+			expectedConfigmapNumber = 1
+		})
+
+		It("should restore the previous shards", func() {
+			shardKey := client.ObjectKey{Namespace: "sharded-rollout", Name: input.Name + "-2"}
+			Eventually(func() error {
+				return k8sclient.Get(ctx, shardKey, &corev1.ConfigMap{})
+			}, 5*time.Second).Should(Succeed(), "should write three shards")
+			deployment := unavailableConsumer(ctx, k8sclient, "sharded-rollout", input.Name)
+			defer k8sclient.Delete(ctx, deployment)
+
+			key := client.ObjectKey{Name: input.Name}
+			result.Spec.Template.Data = map[string]string{"big.txt": strings.Repeat("y", 1500)}
+			Expect(k8sclient.Update(ctx, result)).To(Succeed(), "should shrink the data to two shards")
+			Eventually(func() []replicav1alpha1.ConfigMapReplicaCondition {
+				k8sclient.Get(ctx, key, result)
+				return result.Status.Conditions
+			}, 5*time.Second).Should(ContainElement(WithTransform(func(c replicav1alpha1.ConfigMapReplicaCondition) string {
+				return c.Message
+			}, ContainSubstring("copies reverted to template revision 1"))), "should fail the rollout")
+
+			index := &corev1.ConfigMap{}
+			Eventually(func() string {
+				k8sclient.Get(ctx, client.ObjectKey{Namespace: "sharded-rollout", Name: input.Name}, index)
+				return index.Data["index.json"]
+			}, 5*time.Second).Should(ContainSubstring(`"sharded-rollout-replica-2"`), "should list the previous shards")
+			shard := &corev1.ConfigMap{}
+			Expect(k8sclient.Get(ctx, shardKey, shard)).To(Succeed(), "should keep the previous last shard")
+			for _, value := range shard.Data {
+				Expect(value).To(MatchRegexp("^x+$"))
+			}
+		})
+	})
+
+	Context("template revision history", func() {
+		BeforeEach(func() {
+			namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:   "history-target",
+				Labels: map[string]string{"history": "revisions"},
+			}})
+			input = &replicav1alpha1.ConfigMapReplica{
+				ObjectMeta: metav1.ObjectMeta{Name: "history-replica"},
+				Spec: replicav1alpha1.ConfigMapReplicaSpec{
+					Template: replicav1alpha1.ConfigMapTemplate{
+						Data: map[string]string{"data.yaml": "first value"},
+					},
+					Selector: map[string]string{"history": "revisions"},
+				},
+			}
+			expectedConfigmapNumber = 1
+		})
+
+		It("should restore an old template on rollback", func() {
+			key := client.ObjectKey{Name: input.Name}
+			Expect(result.Status.UpdateRevision).To(Equal(int64(1)))
+			result.Spec.Template.Data = map[string]string{"data.yaml": "second value"}
+			Expect(k8sclient.Update(ctx, result)).To(Succeed(), "should change the template")
+			Eventually(func() int64 {
+				k8sclient.Get(ctx, key, result)
+				return result.Status.CurrentRevision
+			}, 5*time.Second).Should(Equal(int64(2)), "should sync the second revision")
+
+			revisions := &appsv1.ControllerRevisionList{}
+			Expect(k8sclient.List(ctx, revisions, client.InNamespace(metav1.NamespaceDefault), client.MatchingLabels{replicav1alpha1.OwnerUIDLabel: string(result.UID)})).To(Succeed())
+			Expect(revisions.Items).To(HaveLen(2))
+			for _, revision := range revisions.Items {
+				Expect(revision.Name).To(HavePrefix("cmr-"+input.Name+"-"), "should name revisions after the kind")
+			}
+
+			rollbackTo := int64(1)
+			result.Spec.RollbackTo = &rollbackTo
+			Expect(k8sclient.Update(ctx, result)).To(Succeed(), "should roll back")
+			Eventually(func() int64 {
+				k8sclient.Get(ctx, key, result)
+				return result.Status.CurrentRevision
+			}, 5*time.Second).Should(Equal(int64(3)), "should make the restored template the newest revision")
+			Expect(result.Spec.RollbackTo).To(BeNil())
+			Expect(result.Spec.Template.Data).To(Equal(input.Spec.Template.Data))
+
+			copy := &corev1.ConfigMap{}
+			Expect(k8sclient.Get(ctx, client.ObjectKey{Namespace: "history-target", Name: input.Name}, copy)).To(Succeed())
+			Expect(copy.Data).To(Equal(input.Spec.Template.Data))
+		})
+
+		It("should record a revision when only the template labels change", func() {
+			key := client.ObjectKey{Name: input.Name}
+			Expect(result.Status.UpdateRevision).To(Equal(int64(1)))
+			result.Spec.Template.Labels = map[string]string{"team": "platform"}
+			Expect(k8sclient.Update(ctx, result)).To(Succeed(), "should change the template labels")
+			Eventually(func() int64 {
+				k8sclient.Get(ctx, key, result)
+				return result.Status.UpdateRevision
+			}, 5*time.Second).Should(Equal(int64(2)), "should report the new revision")
+			Expect(result.Status.CurrentRevision).To(Equal(int64(2)))
+		})
+	})
+
+	Context("a replica in plan mode", func() {
+		BeforeEach(func() {
+			namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:   "plan-target",
+				Labels: map[string]string{"mode": "plan"},
+			}})
+			input = &replicav1alpha1.ConfigMapReplica{
+				ObjectMeta: metav1.ObjectMeta{Name: "plan-replica"},
+				Spec: replicav1alpha1.ConfigMapReplicaSpec{
+					Template: replicav1alpha1.ConfigMapTemplate{
+						Data: map[string]string{"password": "s3cr3t"},
+					},
+					Selector: map[string]string{"mode": "plan"},
+					Mode:     replicav1alpha1.ReplicaModePlan,
+				},
+			}
+			// nothing is written in plan mode
+			expectedConfigmapNumber = 0
+		})
+
+		It("should report the planned writes without values", func() {
+			key := client.ObjectKey{Name: input.Name}
+			Eventually(func() *replicav1alpha1.ReplicaPlan {
+				k8sclient.Get(ctx, key, result)
+				return result.Status.Plan
+			}, 5*time.Second).ShouldNot(BeNil(), "should publish the plan")
+			Expect(result.Status.Plan.Changes).To(Equal([]replicav1alpha1.PlannedChange{{
+				Operation: "create",
+				Namespace: "plan-target",
+				Name:      input.Name,
+				Data:      []replicav1alpha1.KeyChange{{Key: "password", Change: replicav1alpha1.KeyAdded}},
+			}}))
+
+			copy := &corev1.ConfigMap{}
+			Expect(errors.IsNotFound(k8sclient.Get(ctx, client.ObjectKey{Namespace: "plan-target", Name: input.Name}, copy))).To(BeTrue(), "should not write the copy")
+		})
+	})
+
+	Context("a suspended replica", func() {
+		BeforeEach(func() {
+			namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:   "suspend-target",
+				Labels: map[string]string{"suspend": "replica"},
+			}})
+			input = &replicav1alpha1.ConfigMapReplica{
+				ObjectMeta: metav1.ObjectMeta{Name: "suspend-replica"},
+				Spec: replicav1alpha1.ConfigMapReplicaSpec{
+					Template: replicav1alpha1.ConfigMapTemplate{
+						Data: map[string]string{"data.yaml": "some value for configmap"},
+					},
+					Selector: map[string]string{"suspend": "replica"},
+					Suspend:  true,
+				},
+			}
+			expectedConfigmapNumber = 1
+		})
+
+		It("should hold all writes until resumed", func() {
+			Expect(result.Status.ConfigMapStatuses[0].Reason).To(Equal(replicav1alpha1.ReasonSuspended))
+			Expect(result.Status.Conditions).To(ContainElement(WithTransform(func(c replicav1alpha1.ConfigMapReplicaCondition) replicav1alpha1.ConfigMapReplicaConditionType {
+				return c.Type
+			}, Equal(replicav1alpha1.ConditionSuspended))), "should report the replica suspended")
+			copy := &corev1.ConfigMap{}
+			copyKey := client.ObjectKey{Namespace: "suspend-target", Name: input.Name}
+			Expect(errors.IsNotFound(k8sclient.Get(ctx, copyKey, copy))).To(BeTrue(), "should not write the copy")
+
+			result.Spec.Suspend = false
+			Expect(k8sclient.Update(ctx, result)).To(Succeed(), "should resume the replica")
+			Eventually(func() error {
+				return k8sclient.Get(ctx, copyKey, copy)
+			}, 5*time.Second).Should(Succeed(), "should write the copy once resumed")
+		})
+	})
+
+	Context("rolling out consumers of changed copies", func() {
+		BeforeEach(func() {
+			namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:   "restart-target",
+				Labels: map[string]string{"restart": "consumers"},
+			}})
+			input = &replicav1alpha1.ConfigMapReplica{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "restart-replica",
+					Annotations: map[string]string{replicav1alpha1.AuthorAnnotation: "cluster-admin"},
+				},
+				Spec: replicav1alpha1.ConfigMapReplicaSpec{
+					Template: replicav1alpha1.ConfigMapTemplate{
+						Data: map[string]string{"data.yaml": "first value"},
+					},
+					Selector:         map[string]string{"restart": "consumers"},
+					RolloutConsumers: true,
+				},
+			}
+			expectedConfigmapNumber = 1
+		})
+
+		// changeTemplate creates a deployment consuming the copy, changes the template and
+		// returns the deployment and the copy once it holds the new data
+		changeTemplate := func() (*appsv1.Deployment, *corev1.ConfigMap) {
+			labels := map[string]string{"app": "restart"}
+			deployment := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "restart-target", Name: "restart"},
+				Spec: appsv1.DeploymentSpec{
+					Selector: &metav1.LabelSelector{MatchLabels: labels},
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{Labels: labels},
+						Spec: corev1.PodSpec{Containers: []corev1.Container{{
+							Name:  "app",
+							Image: "app",
+							Env: []corev1.EnvVar{{Name: "DATA", ValueFrom: &corev1.EnvVarSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+								LocalObjectReference: corev1.LocalObjectReference{Name: input.Name},
+								Key:                  "data.yaml",
+							}}}},
+						}}},
+					},
+				},
+			}
+			Expect(k8sclient.Create(ctx, deployment)).To(Succeed())
+
+			result.Spec.Template.Data = map[string]string{"data.yaml": "second value"}
+			Expect(k8sclient.Update(ctx, result)).To(Succeed(), "should change the template")
+			copy := &corev1.ConfigMap{}
+			Eventually(func() string {
+				k8sclient.Get(ctx, client.ObjectKey{Namespace: "restart-target", Name: input.Name}, copy)
+				return copy.Data["data.yaml"]
+			}, 5*time.Second).Should(Equal("second value"))
+			return deployment, copy
+		}
+
+		It("should annotate the pod template with the content hash", func() {
+			deployment, copy := changeTemplate()
+			Eventually(func() string {
+				k8sclient.Get(ctx, client.ObjectKey{Namespace: "restart-target", Name: "restart"}, deployment)
+				return deployment.Spec.Template.Annotations[replicav1alpha1.ConsumerHashAnnotationPrefix+input.Name]
+			}, 5*time.Second).Should(Equal(copy.Annotations[replicav1alpha1.ContentHashAnnotation]), "should roll out the deployment")
+			Expect(k8sclient.Delete(ctx, deployment)).To(Succeed())
+		})
+
+		Context("by an author who may not patch the workloads", func() {
+			BeforeEach(func() {
+				input.Annotations = nil
+			})
+
+			It("should report the consumers instead of rolling them out", func() {
+				deployment, _ := changeTemplate()
+				Eventually(func() string {
+					k8sclient.Get(ctx, client.ObjectKey{Name: input.Name}, result)
+					if len(result.Status.ConfigMapStatuses) == 0 {
+						return ""
+					}
+					return result.Status.ConfigMapStatuses[0].Message
+				}, 5*time.Second).Should(ContainSubstring("consumers not rolled out"))
+				Expect(result.Status.ConfigMapStatuses[0].Message).To(ContainSubstring("deployments.apps"))
+				Expect(k8sclient.Get(ctx, client.ObjectKey{Namespace: "restart-target", Name: "restart"}, deployment)).To(Succeed())
+				Expect(deployment.Spec.Template.Annotations).ToNot(HaveKey(replicav1alpha1.ConsumerHashAnnotationPrefix+input.Name), "should not roll out the deployment")
+				Expect(k8sclient.Delete(ctx, deployment)).To(Succeed())
+			})
+		})
+	})
+
+	Context("changes outside the maintenance windows", func() {
+		BeforeEach(func() {
+			namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:   "window-target",
+				Labels: map[string]string{"window": "prod"},
+			}})
+			input = &replicav1alpha1.ConfigMapReplica{
+				ObjectMeta: metav1.ObjectMeta{Name: "window-replica"},
+				Spec: replicav1alpha1.ConfigMapReplicaSpec{
+					Template: replicav1alpha1.ConfigMapTemplate{
+						Data: map[string]string{"data.yaml": "some value for configmap"},
+					},
+					Selector: map[string]string{"window": "prod"},
+					// a one minute window two days from now
+					Windows: []replicav1alpha1.MaintenanceWindow{{
+						Days:     []string{time.Now().UTC().AddDate(0, 0, 2).Weekday().String()[:3]},
+						Start:    "00:00",
+						End:      "00:01",
+						Selector: map[string]string{"window": "prod"},
+					}},
+				},
+			}
+			expectedConfigmapNumber = 1
+		})
+
+		It("should queue the writes until a window opens", func() {
+			Expect(result.Status.ConfigMapStatuses[0].Reason).To(Equal(replicav1alpha1.ReasonPendingWindow))
+			copy := &corev1.ConfigMap{}
+			copyKey := client.ObjectKey{Namespace: "window-target", Name: input.Name}
+			Expect(errors.IsNotFound(k8sclient.Get(ctx, copyKey, copy))).To(BeTrue(), "should not write the copy")
+
+			result.Spec.Windows = nil
+			Expect(k8sclient.Update(ctx, result)).To(Succeed(), "should remove the window")
+			Eventually(func() error {
+				return k8sclient.Get(ctx, copyKey, copy)
+			}, 5*time.Second).Should(Succeed(), "should write the copy without windows")
+		})
+	})
+
+	Context("tracking the consumers of a copy", func() {
+		BeforeEach(func() {
+			namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:   "consumers-target",
+				Labels: map[string]string{"track": "consumers"},
+			}})
+			input = &replicav1alpha1.ConfigMapReplica{
+				ObjectMeta: metav1.ObjectMeta{Name: "consumers-replica"},
+				Spec: replicav1alpha1.ConfigMapReplicaSpec{
+					Template: replicav1alpha1.ConfigMapTemplate{
+						Data: map[string]string{"data.yaml": "some value for configmap"},
+					},
+					Selector: map[string]string{"track": "consumers"},
+				},
+			}
+			expectedConfigmapNumber = 1
+		})
+
+		It("should list the workloads referencing the copy", func() {
+			labels := map[string]string{"app": "consumer"}
+			deployment := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "consumers-target", Name: "consumer"},
+				Spec: appsv1.DeploymentSpec{
+					Selector: &metav1.LabelSelector{MatchLabels: labels},
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{Labels: labels},
+						Spec: corev1.PodSpec{Containers: []corev1.Container{{
+							Name:    "app",
+							Image:   "app",
+							EnvFrom: []corev1.EnvFromSource{{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: input.Name}}}},
+						}}},
+					},
+				},
+			}
+			Expect(k8sclient.Create(ctx, deployment)).To(Succeed())
+			Eventually(func() []string {
+				k8sclient.Get(ctx, client.ObjectKey{Name: input.Name}, result)
+				if len(result.Status.ConfigMapStatuses) == 0 {
+					return nil
+				}
+				return result.Status.ConfigMapStatuses[0].Consumers
+			}, 5*time.Second).Should(Equal([]string{"Deployment/consumer"}), "should list the deployment")
+			Expect(result.Status.Consumers).To(BeEquivalentTo(1))
+
+			Expect(k8sclient.Delete(ctx, deployment)).To(Succeed())
+			Eventually(func() int32 {
+				k8sclient.Get(ctx, client.ObjectKey{Name: input.Name}, result)
+				return result.Status.Consumers
+			}, 5*time.Second).Should(BeZero(), "should drop the deleted deployment")
+		})
+	})
+
+	Context("template data failing validation", func() {
+		BeforeEach(func() {
+			namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:   "validation-target",
+				Labels: map[string]string{"validate": "data"},
+			}})
+			input = &replicav1alpha1.ConfigMapReplica{
+				ObjectMeta: metav1.ObjectMeta{Name: "validation-replica"},
+				Spec: replicav1alpha1.ConfigMapReplicaSpec{
+					Template: replicav1alpha1.ConfigMapTemplate{
+						Data: map[string]string{"config.yaml": "port: 80\nname: web: app\n"},
+					},
+					Selector: map[string]string{"validate": "data"},
+					Validation: []replicav1alpha1.DataValidation{{
+						Key:    "config.yaml",
+						Format: replicav1alpha1.DataFormatYAML,
+						Schema: &replicav1alpha1.DataSchema{Inline: `{"type": "object", "properties": {"port": {"type": "integer"}}}`},
+					}},
+				},
+			}
+			expectedConfigmapNumber = 0
+		})
+
+		It("should not write the copies until the data is valid", func() {
+			Eventually(func() []replicav1alpha1.ConfigMapReplicaCondition {
+				k8sclient.Get(ctx, client.ObjectKey{Name: input.Name}, result)
+				return result.Status.Conditions
+			}, 5*time.Second).Should(ContainElement(And(
+				WithTransform(func(c replicav1alpha1.ConfigMapReplicaCondition) replicav1alpha1.ConfigMapReplicaConditionType {
+					return c.Type
+				}, Equal(replicav1alpha1.ConditionValidationFailed)),
+				WithTransform(func(c replicav1alpha1.ConfigMapReplicaCondition) string {
+					return c.Message
+				}, ContainSubstring("key config.yaml: invalid yaml: yaml: line 2")),
+			)), "should name the key and the line")
+			copy := &corev1.ConfigMap{}
+			copyKey := client.ObjectKey{Namespace: "validation-target", Name: input.Name}
+			Expect(errors.IsNotFound(k8sclient.Get(ctx, copyKey, copy))).To(BeTrue(), "should not write the copy")
+
+			result.Spec.Template.Data = map[string]string{"config.yaml": "port: 80\nname: web\n"}
+			Expect(k8sclient.Update(ctx, result)).To(Succeed(), "should fix the data")
+			Eventually(func() error {
+				return k8sclient.Get(ctx, copyKey, copy)
+			}, 5*time.Second).Should(Succeed(), "should write the valid data")
+		})
+	})
+
+	Context("data larger than a shard", func() {
+		BeforeEach(func() {
+			namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:   "shard-target",
+				Labels: map[string]string{"shard": "data"},
+			}})
+			maxShardBytes := int32(1024)
+			input = &replicav1alpha1.ConfigMapReplica{
+				ObjectMeta: metav1.ObjectMeta{Name: "shard-replica"},
+				Spec: replicav1alpha1.ConfigMapReplicaSpec{
+					Template: replicav1alpha1.ConfigMapTemplate{
+						Data: map[string]string{"big.txt": strings.Repeat("x", 1500), "small.txt": "small"},
+					},
+					Selector: map[string]string{"shard": "data"},
+					Sharding: &replicav1alpha1.Sharding{MaxShardBytes: &maxShardBytes},
+				},
+			}
+			expectedConfigmapNumber = 1
+		})
+
+		It("should split the data across shards listed in an index", func() {
+			index := &corev1.ConfigMap{}
+			Eventually(func() string {
+				k8sclient.Get(ctx, client.ObjectKey{Namespace: "shard-target", Name: input.Name}, index)
+				return index.Data["index.json"]
+			}, 5*time.Second).ShouldNot(BeEmpty(), "should write the index")
+			Expect(index.Data["index.json"]).To(ContainSubstring(`"shards":["shard-replica-0","shard-replica-1"]`))
+			shard := &corev1.ConfigMap{}
+			shardKey := client.ObjectKey{Namespace: "shard-target", Name: input.Name + "-1"}
+			Expect(k8sclient.Get(ctx, shardKey, shard)).To(Succeed(), "should write the shards")
+			Expect(shard.Data).To(HaveKey("big.txt.part-1"))
+
+			result.Spec.Template.Data = map[string]string{"small.txt": "small"}
+			Expect(k8sclient.Update(ctx, result)).To(Succeed(), "should shrink the data")
+			Eventually(func() bool {
+				return errors.IsNotFound(k8sclient.Get(ctx, shardKey, shard))
+			}, 5*time.Second).Should(BeTrue(), "should delete the leftover shards")
+			Expect(k8sclient.Get(ctx, client.ObjectKey{Namespace: "shard-target", Name: input.Name}, index)).To(Succeed())
+			Expect(index.Data).To(Equal(map[string]string{"small.txt": "small"}))
+		})
+	})
+
+	Context("sharded data from an http source larger than a ConfigMap", func() {
+		var server *httptest.Server
+
+		BeforeEach(func() {
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Write([]byte(`{"big": "` + strings.Repeat("x", 3<<19) + `"}`))
+			}))
+			namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:   "shard-source-target",
+				Labels: map[string]string{"shard": "source"},
+			}})
+			input = &replicav1alpha1.ConfigMapReplica{
+				ObjectMeta: metav1.ObjectMeta{Name: "shard-source-replica"},
+				Spec: replicav1alpha1.ConfigMapReplicaSpec{
+					Selector: map[string]string{"shard": "source"},
+					Source:   &replicav1alpha1.ConfigMapSource{HTTP: &replicav1alpha1.HTTPSource{URL: server.URL}},
+					Sharding: &replicav1alpha1.Sharding{},
+				},
+			}
+			expectedConfigmapNumber = 1
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("should shard the document", func() {
+			Expect(result.Status.Conditions).To(BeEmpty(), "should accept a document larger than 1MiB")
+			index := &corev1.ConfigMap{}
+			Expect(k8sclient.Get(ctx, client.ObjectKey{Namespace: "shard-source-target", Name: input.Name}, index)).To(Succeed())
+			Expect(index.Data["index.json"]).To(ContainSubstring(`"shards":["shard-source-replica-0","shard-source-replica-1"]`))
+		})
+	})
+
+	Context("age encrypted template data", func() {
+		var secret *corev1.Secret
+
+		BeforeEach(func() {
+			identity, err := age.GenerateX25519Identity()
+			Expect(err).ToNot(HaveOccurred())
+			ciphertext := &bytes.Buffer{}
+			armored := armor.NewWriter(ciphertext)
+			plaintext, err := age.Encrypt(armored, identity.Recipient())
+			Expect(err).ToNot(HaveOccurred())
+			plaintext.Write([]byte("password: s3cr3t"))
+			Expect(plaintext.Close()).To(Succeed())
+			Expect(armored.Close()).To(Succeed())
+
+			secret = &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "age-identity"},
+				Data:       map[string][]byte{"age.agekey": []byte(identity.String())},
+			}
+			Expect(k8sclient.Create(ctx, secret)).To(Succeed())
+
+			namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:   "encrypted-target",
+				Labels: map[string]string{"encrypted": "test"},
+			}})
+			input = &replicav1alpha1.ConfigMapReplica{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "encrypted-replica",
+					// the test api server allows every access review of a known user
+					Annotations: map[string]string{replicav1alpha1.AuthorAnnotation: "cluster-admin"},
+				},
+				Spec: replicav1alpha1.ConfigMapReplicaSpec{
+					Template: replicav1alpha1.ConfigMapTemplate{
+						Data:          map[string]string{"plain.yaml": "user: admin"},
+						EncryptedData: map[string]string{"secret.yaml": ciphertext.String()},
+					},
+					Selector: map[string]string{"encrypted": "test"},
+					Decryption: &replicav1alpha1.Decryption{
+						SecretRef: replicav1alpha1.SecretReference{Namespace: "default", Name: "age-identity"},
+					},
+				},
+			}
+			expectedConfigmapNumber = 1
+		})
+
+		AfterEach(func() {
+			k8sclient.Delete(ctx, secret)
+		})
+
+		It("should replicate the decrypted data", func() {
+			copy := &corev1.ConfigMap{}
+			Expect(k8sclient.Get(ctx, client.ObjectKey{Namespace: "encrypted-target", Name: input.Name}, copy)).To(Succeed())
+			Expect(copy.Data).To(Equal(map[string]string{"plain.yaml": "user: admin", "secret.yaml": "password: s3cr3t"}))
+			Expect(result.Status.Conditions).To(BeEmpty())
+		})
+
+		Context("with an author who may not read the key", func() {
+			BeforeEach(func() {
+				input.Annotations = nil
+				expectedConfigmapNumber = 0
+			})
+
+			It("should not decrypt the data", func() {
+				Eventually(func() []replicav1alpha1.ConfigMapReplicaCondition {
+					k8sclient.Get(ctx, client.ObjectKey{Name: input.Name}, result)
+					return result.Status.Conditions
+				}, 5*time.Second).Should(ContainElement(WithTransform(func(c replicav1alpha1.ConfigMapReplicaCondition) string {
+					return string(c.Type) + ": " + c.Message
+				}, And(HavePrefix(string(replicav1alpha1.ConditionDecryptionFailed)), ContainSubstring("decryption.secretRef")))))
+
+				err := k8sclient.Get(ctx, client.ObjectKey{Namespace: "encrypted-target", Name: input.Name}, &corev1.ConfigMap{})
+				Expect(err).To(HaveOccurred(), "should not copy without the decrypted data")
+			})
+		})
 	})
 })
+
+// unavailableConsumer creates a Deployment mounting the ConfigMap and reports it unavailable
+func unavailableConsumer(ctx context.Context, c client.Client, namespace, configMap string) *appsv1.Deployment {
+	labels := map[string]string{"app": configMap}
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: configMap},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "app", Image: "app"}},
+					Volumes: []corev1.Volume{{Name: "config", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+						LocalObjectReference: corev1.LocalObjectReference{Name: configMap},
+					}}}},
+				},
+			},
+		},
+	}
+	Expect(c.Create(ctx, deployment)).To(Succeed())
+	deployment.Status.Conditions = []appsv1.DeploymentCondition{{Type: appsv1.DeploymentAvailable, Status: corev1.ConditionFalse}}
+	Expect(c.Status().Update(ctx, deployment)).To(Succeed(), "should mark the consumer unavailable")
+	return deployment
+}
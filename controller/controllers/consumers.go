@@ -0,0 +1,258 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+
+	replicav1alpha1 "github.com/danielfbm/k8s-design-workshop/controller/api/v1alpha1"
+)
+
+// consumerIndex field index of the consumer kinds by the names of the ConfigMaps their pod spec references
+const consumerIndex = "spec.configMapRefs"
+
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+// +kubebuilder:rbac:groups=apps,resources=deployments;statefulsets;daemonsets;replicasets,verbs=get;list;watch
+// +kubebuilder:rbac:groups=batch,resources=jobs;cronjobs,verbs=get;list;watch
+
+// consumerKinds workloads indexed and watched as consumers of copies
+func consumerKinds() []runtime.Object {
+	return []runtime.Object{&corev1.Pod{}, &appsv1.Deployment{}, &appsv1.StatefulSet{}, &appsv1.DaemonSet{},
+		&appsv1.ReplicaSet{}, &batchv1.Job{}, &batchv1beta1.CronJob{}}
+}
+
+// consumerLists lists of the consumer kinds
+func consumerLists() []runtime.Object {
+	return []runtime.Object{&corev1.PodList{}, &appsv1.DeploymentList{}, &appsv1.StatefulSetList{}, &appsv1.DaemonSetList{},
+		&appsv1.ReplicaSetList{}, &batchv1.JobList{}, &batchv1beta1.CronJobList{}}
+}
+
+// workload returns the kind and pod spec of a consumer kind and whether it counts as a consumer.
+// Pods, ReplicaSets and Jobs controlled by another object do not, the workload controlling
+// them does, and neither do finished Pods and Jobs
+func workload(obj runtime.Object) (string, *corev1.PodSpec, bool) {
+	switch o := obj.(type) {
+	case *corev1.Pod:
+		return "Pod", &o.Spec, metav1.GetControllerOf(o) == nil && o.Status.Phase != corev1.PodSucceeded && o.Status.Phase != corev1.PodFailed
+	case *appsv1.Deployment:
+		return "Deployment", &o.Spec.Template.Spec, true
+	case *appsv1.StatefulSet:
+		return "StatefulSet", &o.Spec.Template.Spec, true
+	case *appsv1.DaemonSet:
+		return "DaemonSet", &o.Spec.Template.Spec, true
+	case *appsv1.ReplicaSet:
+		return "ReplicaSet", &o.Spec.Template.Spec, metav1.GetControllerOf(o) == nil
+	case *batchv1.Job:
+		return "Job", &o.Spec.Template.Spec, metav1.GetControllerOf(o) == nil && o.Status.CompletionTime == nil
+	case *batchv1beta1.CronJob:
+		return "CronJob", &o.Spec.JobTemplate.Spec.Template.Spec, true
+	}
+	return "", nil, false
+}
+
+// consumedConfigMaps returns the names of the ConfigMaps a consumer references, none when it does not count
+func consumedConfigMaps(obj runtime.Object) []string {
+	_, spec, counted := workload(obj)
+	if !counted {
+		return nil
+	}
+	return configMapRefs(spec)
+}
+
+var (
+	indexedLock sync.Mutex
+	// indexed field indexers the consumer index was added to, the controllers of a manager share it
+	indexed = map[client.FieldIndexer]bool{}
+)
+
+// indexConsumers adds the consumer index to the cache of the manager for every consumer kind
+func indexConsumers(mgr ctrl.Manager) error {
+	indexedLock.Lock()
+	defer indexedLock.Unlock()
+	indexer := mgr.GetFieldIndexer()
+	if indexed[indexer] {
+		return nil
+	}
+	for _, kind := range consumerKinds() {
+		if err := indexer.IndexField(kind, consumerIndex, consumedConfigMaps); err != nil {
+			return err
+		}
+	}
+	indexed[indexer] = true
+	return nil
+}
+
+// consumerEvents enqueues the replicas mapped from a consumer, ignoring updates that change
+// neither the ConfigMaps it references nor whether it counts as a consumer
+func consumerEvents(toRequests handler.ToRequestsFunc) handler.EventHandler {
+	enqueue := &handler.EnqueueRequestsFromMapFunc{ToRequests: toRequests}
+	return handler.Funcs{
+		CreateFunc:  enqueue.Create,
+		DeleteFunc:  enqueue.Delete,
+		GenericFunc: enqueue.Generic,
+		UpdateFunc: func(e event.UpdateEvent, q workqueue.RateLimitingInterface) {
+			if !reflect.DeepEqual(consumedConfigMaps(e.ObjectOld), consumedConfigMaps(e.ObjectNew)) {
+				enqueue.Update(e, q)
+			}
+		},
+	}
+}
+
+// copyOwners returns the UIDs of the replicas managing the copies a consumer references
+func copyOwners(c client.Client, obj handler.MapObject) map[string]bool {
+	_, spec, _ := workload(obj.Object)
+	if spec == nil {
+		return nil
+	}
+	owners := map[string]bool{}
+	for _, name := range configMapRefs(spec) {
+		cm := &corev1.ConfigMap{}
+		if err := c.Get(context.Background(), types.NamespacedName{Namespace: obj.Meta.GetNamespace(), Name: name}, cm); err != nil {
+			continue
+		}
+		if uid, ok := cm.Labels[replicav1alpha1.OwnerUIDLabel]; ok {
+			owners[uid] = true
+		}
+	}
+	return owners
+}
+
+// consumers returns the workloads in namespace of the cluster referencing the ConfigMap name
+// through volumes, envFrom or valueFrom, as Kind/name. The local cluster is served by the
+// consumer index of the cache, remote clusters are listed
+func consumers(ctx context.Context, cl *cluster, namespace, name string) ([]string, error) {
+	opts := []client.ListOption{client.InNamespace(namespace)}
+	if cl.local() {
+		opts = append(opts, client.MatchingFields{consumerIndex: name})
+	}
+	var found []string
+	for _, list := range consumerLists() {
+		if err := cl.List(ctx, list, opts...); err != nil {
+			return nil, err
+		}
+		items, err := meta.ExtractList(list)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			kind, spec, counted := workload(item)
+			if !counted || !referencesConfigMap(spec, name) {
+				continue
+			}
+			accessor, err := meta.Accessor(item)
+			if err != nil {
+				return nil, err
+			}
+			found = append(found, kind+"/"+accessor.GetName())
+		}
+	}
+	sort.Strings(found)
+	return found, nil
+}
+
+// configMapRefs returns the names of the ConfigMaps used by the volumes and containers of the pod spec
+func configMapRefs(spec *corev1.PodSpec) []string {
+	var names []string
+	for _, volume := range spec.Volumes {
+		if volume.ConfigMap != nil {
+			names = append(names, volume.ConfigMap.Name)
+		}
+		if volume.Projected != nil {
+			for _, source := range volume.Projected.Sources {
+				if source.ConfigMap != nil {
+					names = append(names, source.ConfigMap.Name)
+				}
+			}
+		}
+	}
+	containers := append(append([]corev1.Container{}, spec.InitContainers...), spec.Containers...)
+	for _, container := range containers {
+		for _, from := range container.EnvFrom {
+			if from.ConfigMapRef != nil {
+				names = append(names, from.ConfigMapRef.Name)
+			}
+		}
+		for _, env := range container.Env {
+			if env.ValueFrom != nil && env.ValueFrom.ConfigMapKeyRef != nil {
+				names = append(names, env.ValueFrom.ConfigMapKeyRef.Name)
+			}
+		}
+	}
+	sort.Strings(names)
+	unique := names[:0]
+	for i, name := range names {
+		if i == 0 || names[i-1] != name {
+			unique = append(unique, name)
+		}
+	}
+	return unique
+}
+
+// referencesConfigMap returns true when a volume or container of the pod spec uses the ConfigMap
+func referencesConfigMap(spec *corev1.PodSpec, name string) bool {
+	return containsString(configMapRefs(spec), name)
+}
+
+// forcePrune returns true when copies should be deleted even if workloads still reference them
+func (r *replication) forcePrune() bool {
+	return r.owner.GetAnnotations()[replicav1alpha1.ForcePruneAnnotation] == "true"
+}
+
+// inUseCopy status reported for a copy whose deletion waits for its consumers
+func inUseCopy(cluster string, cm *corev1.ConfigMap, found []string) replicav1alpha1.ConfigMapReplicaCopy {
+	return replicav1alpha1.ConfigMapReplicaCopy{
+		Cluster:   cluster,
+		Name:      cm.Name,
+		Namespace: cm.Namespace,
+		Reason:    replicav1alpha1.ReasonInUse,
+		Message:   "deletion deferred, referenced by " + strings.Join(found, ", "),
+		Consumers: found,
+	}
+}
+
+// trackConsumers lists the consumers of each copy of the local cluster in its status,
+// copies of other owners excepted
+func (r *replication) trackConsumers(ctx context.Context, plan *replicationPlan) error {
+	for _, cp := range plan.clusters {
+		if !cp.cluster.local() {
+			continue
+		}
+		for i := range cp.statuses {
+			status := &cp.statuses[i]
+			if status.Reason == replicav1alpha1.ReasonConflict || status.Reason == replicav1alpha1.ReasonInUse {
+				continue
+			}
+			found, err := consumers(ctx, &cp.cluster, status.Namespace, status.Name)
+			if err != nil {
+				return err
+			}
+			status.Consumers = found
+		}
+	}
+	return nil
+}
+
+// countConsumers returns the number of consumers listed in the copy statuses
+func countConsumers(statuses []replicav1alpha1.ConfigMapReplicaCopy) int32 {
+	var count int32
+	for _, status := range statuses {
+		count += int32(len(status.Consumers))
+	}
+	return count
+}
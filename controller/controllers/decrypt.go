@@ -0,0 +1,129 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	replicav1alpha1 "github.com/danielfbm/k8s-design-workshop/controller/api/v1alpha1"
+)
+
+// defaultAgeKey Secret key used when a Decryption does not set one
+const defaultAgeKey = "age.agekey"
+
+// decryptTemplate decrypts the encrypted template data of a replica into its replication
+// and reports failures in the DecryptionFailed condition. It returns false when the data
+// could not be decrypted, in which case the copies should be left untouched.
+// Plaintext is never logged nor written to the status
+func decryptTemplate(ctx context.Context, reader client.Reader, replica types.NamespacedName, rep *replication) bool {
+	if len(rep.spec.Template.EncryptedData) == 0 {
+		rep.decrypted = nil
+		removeCondition(rep.status, replicav1alpha1.ConditionDecryptionFailed)
+		return true
+	}
+
+	// the author must be allowed to read the key, otherwise anyone able to create a replica could
+	// decrypt with the key of another team. A missing decryption or namespace is reported by decryptData
+	var err error
+	if namespace := decryptionNamespace(replica.Namespace, rep.spec); namespace != "" {
+		err = rep.readableSecret(ctx, namespace, "decryption.secretRef")
+	}
+	var decrypted map[string]string
+	if err == nil {
+		decrypted, err = decryptData(ctx, reader, replica.Namespace, rep.spec)
+	}
+	if err != nil {
+		rep.log.Error(err, "decrypting template data")
+		setCondition(rep.status, replicav1alpha1.ConditionDecryptionFailed, corev1.ConditionTrue, "DecryptionFailed", err.Error())
+		return false
+	}
+	removeCondition(rep.status, replicav1alpha1.ConditionDecryptionFailed)
+	rep.decrypted = decrypted
+	return true
+}
+
+// decryptionNamespace namespace of the decryption Secret of a replica in namespace, empty when unknown
+func decryptionNamespace(namespace string, spec *replicav1alpha1.ConfigMapReplicaSpec) string {
+	switch {
+	case spec.Decryption == nil:
+		return ""
+	case spec.Decryption.SecretRef.Namespace != "":
+		return spec.Decryption.SecretRef.Namespace
+	}
+	return namespace
+}
+
+// decryptData decrypts every encrypted value with the identities of the replica Secret
+func decryptData(ctx context.Context, reader client.Reader, namespace string, spec *replicav1alpha1.ConfigMapReplicaSpec) (map[string]string, error) {
+	if spec.Decryption == nil {
+		return nil, fmt.Errorf("template.encryptedData requires spec.decryption")
+	}
+	ref := spec.Decryption.SecretRef
+	switch {
+	case ref.Namespace == "" && namespace == "":
+		return nil, fmt.Errorf("decryption.secretRef.namespace is required")
+	case ref.Namespace == "":
+		ref.Namespace = namespace
+	case namespace != "" && ref.Namespace != namespace:
+		return nil, fmt.Errorf("decryption.secretRef must be in namespace %s", namespace)
+	}
+	key := spec.Decryption.Key
+	if key == "" {
+		key = defaultAgeKey
+	}
+
+	secret := &corev1.Secret{}
+	if err := reader.Get(ctx, types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}, secret); err != nil {
+		return nil, err
+	}
+	keys, ok := secret.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("secret %s/%s has no key %s", ref.Namespace, ref.Name, key)
+	}
+	identities, err := age.ParseIdentities(bytes.NewReader(keys))
+	if err != nil {
+		return nil, fmt.Errorf("secret %s/%s: %v", ref.Namespace, ref.Name, err)
+	}
+
+	data := make(map[string]string, len(spec.Template.EncryptedData))
+	for k, v := range spec.Template.EncryptedData {
+		if data[k], err = decryptValue(v, identities); err != nil {
+			return nil, fmt.Errorf("encryptedData %s: %v", k, err)
+		}
+	}
+	return data, nil
+}
+
+// decryptValue decrypts an ASCII armored or base64 encoded age ciphertext
+func decryptValue(value string, identities []age.Identity) (string, error) {
+	var ciphertext []byte
+	if strings.HasPrefix(strings.TrimSpace(value), armor.Header) {
+		armored, err := ioutil.ReadAll(armor.NewReader(strings.NewReader(value)))
+		if err != nil {
+			return "", err
+		}
+		ciphertext = armored
+	} else {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return "", fmt.Errorf("neither ASCII armored nor base64 encoded")
+		}
+		ciphertext = decoded
+	}
+
+	plaintext, err := age.Decrypt(bytes.NewReader(ciphertext), identities...)
+	if err != nil {
+		return "", err
+	}
+	out, err := ioutil.ReadAll(plaintext)
+	return string(out), err
+}
@@ -0,0 +1,103 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+
+	replicav1alpha1 "github.com/danielfbm/k8s-design-workshop/controller/api/v1alpha1"
+)
+
+// finalize applies the deletion policy to every copy of the replica in all clusters
+// and reports the progress in the Deleting condition. Once it returns nil all copies
+// are handled and the finalizer can be removed. Copies in use are only deleted once
+// their consumers are gone or pruning is forced, they remain in the copy statuses
+func (r *replication) finalize(ctx context.Context) error {
+	policy := r.spec.DeletionPolicy
+	if policy == "" {
+		policy = replicav1alpha1.DeletionPolicyDelete
+	}
+
+	var errs []error
+	plan := &replicationPlan{}
+	for _, cl := range r.clusters() {
+		if cl.outOfScope != "" || cl.forbidden != "" {
+			continue
+		}
+		if cl.err != nil {
+			errs = append(errs, cl.err)
+			continue
+		}
+		cp := &clusterPlan{cluster: cl, log: r.log.WithValues("cluster", cl.name)}
+		var err error
+		if policy == replicav1alpha1.DeletionPolicyDelete {
+			err = r.planPrune(ctx, cp, nil, nil)
+		} else {
+			err = r.planRelease(ctx, cp, policy)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		plan.clusters = append(plan.clusters, cp)
+	}
+
+	// copies in use keep the finalizer until their consumers are gone
+	inUse := plan.statuses()
+	total := plan.changes() + len(inUse)
+	failed := len(inUse)
+	if err := plan.apply(ctx); err != nil {
+		if agg, ok := err.(utilerrors.Aggregate); ok {
+			failed += len(agg.Errors())
+		}
+		errs = append(errs, err)
+	}
+	if len(inUse) > 0 {
+		errs = append(errs, fmt.Errorf("%d copies in use", len(inUse)))
+	}
+	err := utilerrors.NewAggregate(errs)
+	r.status.ConfigMapStatuses = mergeCopyStatuses(r.status.ConfigMapStatuses, inUse)
+
+	message := fmt.Sprintf("%s policy applied to %d of %d copies", policy, total-failed, total)
+	if err != nil {
+		message += ": " + err.Error()
+	}
+	setCondition(r.status, replicav1alpha1.ConditionDeleting, corev1.ConditionTrue, string(policy), message)
+	return err
+}
+
+// planRelease plans updating every copy so it outlives the replica. Copies keep their data,
+// with Orphan they also lose the labels and annotations marking them as managed
+func (r *replication) planRelease(ctx context.Context, cp *clusterPlan, policy replicav1alpha1.DeletionPolicy) error {
+	copies, err := r.copies(ctx, cp.cluster)
+	if err != nil {
+		return err
+	}
+	for i := range copies {
+		cm := &copies[i]
+		desired := cm.DeepCopy()
+		var refs []metav1.OwnerReference
+		for _, ref := range desired.OwnerReferences {
+			if ref.UID != r.owner.GetUID() {
+				refs = append(refs, ref)
+			}
+		}
+		desired.OwnerReferences = refs
+		if policy == replicav1alpha1.DeletionPolicyOrphan {
+			delete(desired.Labels, replicav1alpha1.OwnerUIDLabel)
+			delete(desired.Labels, replicav1alpha1.NameLabel)
+			if desired.Labels[replicav1alpha1.ManagedByLabel] == replicav1alpha1.ManagedByValue {
+				delete(desired.Labels, replicav1alpha1.ManagedByLabel)
+			}
+			delete(desired.Annotations, replicav1alpha1.ContentHashAnnotation)
+		} else if len(refs) == len(cm.OwnerReferences) {
+			// retained copies without an owner reference need no write
+			continue
+		}
+		cp.actions = append(cp.actions, copyAction{operation: operationRelease, status: -1, current: cm, desired: desired})
+	}
+	return nil
+}
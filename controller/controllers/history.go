@@ -0,0 +1,203 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	replicav1alpha1 "github.com/danielfbm/k8s-design-workshop/controller/api/v1alpha1"
+)
+
+const (
+	// defaultRevisionHistoryLimit revisions kept when a replica does not set a limit
+	defaultRevisionHistoryLimit = 10
+	// templateHashLabel hash of the template stored in a ControllerRevision
+	templateHashLabel = "replica.example.com/template-hash"
+)
+
+// +kubebuilder:rbac:groups=apps,resources=controllerrevisions,verbs=get;list;watch;create;update;patch;delete
+
+// revisionHistory stores each distinct template of a replica as a ControllerRevision
+// owned by the replica. Revisions of cluster scoped replicas live in namespace
+type revisionHistory struct {
+	client.Client
+	scheme    *runtime.Scheme
+	owner     metav1.Object
+	namespace string
+}
+
+// revisions returns the revisions of the replica ordered by revision number
+func (h *revisionHistory) revisions(ctx context.Context) ([]appsv1.ControllerRevision, error) {
+	list := &appsv1.ControllerRevisionList{}
+	err := h.List(ctx, list, client.InNamespace(h.namespace), client.MatchingLabels{replicav1alpha1.OwnerUIDLabel: string(h.owner.GetUID())})
+	sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Revision < list.Items[j].Revision })
+	return list.Items, err
+}
+
+// record stores the template as the newest revision, reusing the revision of an identical
+// template, and prunes the oldest revisions beyond limit. It returns the revision number
+func (h *revisionHistory) record(ctx context.Context, template *replicav1alpha1.ConfigMapTemplate, limit *int32, current int64) (int64, error) {
+	raw, err := json.Marshal(template)
+	if err != nil {
+		return 0, err
+	}
+	sum := sha256.Sum256(raw)
+	hash := hex.EncodeToString(sum[:])[:10]
+
+	revisions, err := h.revisions(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var latest int64
+	var found *appsv1.ControllerRevision
+	for i := range revisions {
+		if revisions[i].Labels[templateHashLabel] == hash {
+			found = &revisions[i]
+		}
+		latest = revisions[i].Revision
+	}
+
+	var revision int64
+	switch {
+	case found != nil && found.Revision == latest:
+		revision = latest
+	case found != nil:
+		// an older template is back, it becomes the newest revision
+		found.Revision = latest + 1
+		if err = h.Update(ctx, found); err != nil {
+			return 0, err
+		}
+		revision = found.Revision
+	default:
+		created := &appsv1.ControllerRevision{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: h.namespace,
+				Name:      h.revisionName(hash),
+				Labels: map[string]string{
+					replicav1alpha1.OwnerUIDLabel: string(h.owner.GetUID()),
+					templateHashLabel:             hash,
+				},
+			},
+			Data:     runtime.RawExtension{Raw: raw},
+			Revision: latest + 1,
+		}
+		if err = controllerutil.SetControllerReference(h.owner, created, h.scheme); err != nil {
+			return 0, err
+		}
+		if err = h.Create(ctx, created); err != nil {
+			return 0, err
+		}
+		revision = created.Revision
+		revisions = append(revisions, *created)
+	}
+
+	keep := defaultRevisionHistoryLimit
+	if limit != nil {
+		keep = int(*limit)
+	}
+	sort.Slice(revisions, func(i, j int) bool { return revisions[i].Revision < revisions[j].Revision })
+	prunable := 0
+	for i := range revisions {
+		if revisions[i].Revision != revision && revisions[i].Revision != current {
+			prunable++
+		}
+	}
+	for i := 0; i < len(revisions) && prunable > keep; i++ {
+		if revisions[i].Revision == revision || revisions[i].Revision == current {
+			continue
+		}
+		if err = h.Delete(ctx, &revisions[i]); err != nil {
+			return revision, err
+		}
+		prunable--
+	}
+	return revision, nil
+}
+
+// revisionName names the revision of a template hash after the kind and name of the owner,
+// as a ConfigMapReplica and a NamespacedConfigMapReplica of the same name may store their
+// revisions in the same namespace. Owner names too long for the name limit are truncated
+// and suffixed with a hash of the full name, so owners sharing a prefix keep apart
+func (h *revisionHistory) revisionName(hash string) string {
+	prefix := "cmr-"
+	if _, ok := h.owner.(*replicav1alpha1.NamespacedConfigMapReplica); ok {
+		prefix = "ncmr-"
+	}
+	name := h.owner.GetName()
+	maxName := validation.DNS1123SubdomainMaxLength - len(prefix) - len("-") - len(hash)
+	if len(name) > maxName {
+		sum := sha256.Sum256([]byte(name))
+		name = strings.TrimRight(name[:maxName-11], ".-") + "-" + hex.EncodeToString(sum[:])[:10]
+	}
+	return prefix + name + "-" + hash
+}
+
+// rollback restores the template of the RollbackTo revision into the spec and clears
+// RollbackTo. It returns true when the spec changed and has to be written. A missing
+// revision is reported in the RollbackFailed condition
+func (h *revisionHistory) rollback(ctx context.Context, spec *replicav1alpha1.ConfigMapReplicaSpec, status *replicav1alpha1.ConfigMapReplicaStatus) (bool, error) {
+	if spec.RollbackTo == nil {
+		removeCondition(status, replicav1alpha1.ConditionRollbackFailed)
+		return false, nil
+	}
+	template, err := h.template(ctx, *spec.RollbackTo)
+	if err != nil {
+		return false, err
+	}
+	if template != nil {
+		spec.Template = *template
+		spec.RollbackTo = nil
+		removeCondition(status, replicav1alpha1.ConditionRollbackFailed)
+		return true, nil
+	}
+	setCondition(status, replicav1alpha1.ConditionRollbackFailed, corev1.ConditionTrue, "RevisionNotFound",
+		fmt.Sprintf("revision %d not found, clear rollbackTo or set an existing revision", *spec.RollbackTo))
+	return false, nil
+}
+
+// template returns the template stored in a revision, nil when the revision is not recorded
+func (h *revisionHistory) template(ctx context.Context, number int64) (*replicav1alpha1.ConfigMapTemplate, error) {
+	revisions, err := h.revisions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, revision := range revisions {
+		if revision.Revision != number {
+			continue
+		}
+		template := &replicav1alpha1.ConfigMapTemplate{}
+		if err = json.Unmarshal(revision.Data.Raw, template); err != nil {
+			return nil, fmt.Errorf("revision %d: %v", revision.Revision, err)
+		}
+		return template, nil
+	}
+	return nil, nil
+}
+
+// synced records the update revision as current once a sync left no copy behind
+func synced(status *replicav1alpha1.ConfigMapReplicaStatus) {
+	// nothing is written in Plan mode
+	if status.Plan != nil || (status.Rollout != nil && status.Rollout.Wave != "") {
+		return
+	}
+	if findCondition(status, replicav1alpha1.ConditionSuspended) != nil ||
+		findCondition(status, replicav1alpha1.ConditionRolloutFailed) != nil ||
+		findCondition(status, replicav1alpha1.ConditionBlastRadiusExceeded) != nil ||
+		findCondition(status, replicav1alpha1.ConditionQuotaExceeded) != nil ||
+		pendingWindow(status) {
+		return
+	}
+	status.CurrentRevision = status.UpdateRevision
+}
@@ -0,0 +1,46 @@
+package controllers
+
+import (
+	"strings"
+
+	replicav1alpha1 "github.com/danielfbm/k8s-design-workshop/controller/api/v1alpha1"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+var _ = Describe("revisionHistory.revisionName", func() {
+
+	const hash = "0123456789"
+
+	It("should name revisions after the kind and name of the owner", func() {
+		replica := &revisionHistory{owner: &replicav1alpha1.ConfigMapReplica{ObjectMeta: metav1.ObjectMeta{Name: "replica"}}}
+		Expect(replica.revisionName(hash)).To(Equal("cmr-replica-" + hash))
+		namespaced := &revisionHistory{owner: &replicav1alpha1.NamespacedConfigMapReplica{ObjectMeta: metav1.ObjectMeta{Name: "replica"}}}
+		Expect(namespaced.revisionName(hash)).To(Equal("ncmr-replica-" + hash))
+	})
+
+	It("should keep the names of maximum length owners valid and apart", func() {
+		long := strings.Repeat("a", validation.DNS1123SubdomainMaxLength)
+		other := long[:len(long)-1] + "b"
+		var names []string
+		for _, h := range []*revisionHistory{
+			{owner: &replicav1alpha1.ConfigMapReplica{ObjectMeta: metav1.ObjectMeta{Name: long}}},
+			{owner: &replicav1alpha1.ConfigMapReplica{ObjectMeta: metav1.ObjectMeta{Name: other}}},
+			{owner: &replicav1alpha1.NamespacedConfigMapReplica{ObjectMeta: metav1.ObjectMeta{Name: long}}},
+		} {
+			name := h.revisionName(hash)
+			Expect(validation.IsDNS1123Subdomain(name)).To(BeEmpty(), "revision name %s", name)
+			Expect(name).To(HaveSuffix("-" + hash))
+			names = append(names, name)
+		}
+		Expect(names[0]).ToNot(Equal(names[1]), "should not share the revisions of owners with the same prefix")
+	})
+
+	It("should not end the truncated name part with a separator", func() {
+		name := strings.Repeat("a", 226) + "." + strings.Repeat("b", 26)
+		h := &revisionHistory{owner: &replicav1alpha1.ConfigMapReplica{ObjectMeta: metav1.ObjectMeta{Name: name}}}
+		Expect(validation.IsDNS1123Subdomain(h.revisionName(hash))).To(BeEmpty())
+	})
+})
@@ -0,0 +1,212 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	replicav1alpha1 "github.com/danielfbm/k8s-design-workshop/controller/api/v1alpha1"
+)
+
+const (
+	// DefaultTenantLabel namespace label used to group namespaces by tenant
+	DefaultTenantLabel = "tenant"
+
+	// copiesFinalizer keeps a replica around until its deletion policy is applied to all copies
+	copiesFinalizer = "replica.example.com/copies"
+)
+
+// NamespacedConfigMapReplicaReconciler reconciles a NamespacedConfigMapReplica object
+type NamespacedConfigMapReplicaReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+
+	// TenantLabel namespace label that identifies the tenant owning a namespace.
+	// A replica may only write to namespaces with the same value as its own namespace.
+	// Defaults to DefaultTenantLabel
+	TenantLabel string
+
+	// CheckAccess only writes copies to namespaces where the author or
+	// service account of the replica may create and update ConfigMaps
+	CheckAccess bool
+
+	// ProtectedNamespaces namespaces only written to when a replica lists them
+	// in spec.namespaces and a ReplicationPolicy allows it
+	ProtectedNamespaces []string
+
+	// MaxChanges copies a single sync may create, update or delete before it
+	// needs approval. Replicas can only lower it, 0 means no limit
+	MaxChanges int
+
+	// ClusterQuota limits the copies of all replicas together, nil means no limit
+	ClusterQuota *replicav1alpha1.ReplicaQuota
+
+	// sources last good documents of replica sources
+	sources *httpSources
+	// secrets reads decryption keys without caching Secrets in the manager
+	secrets client.Reader
+}
+
+// +kubebuilder:rbac:groups=replica.example.com,resources=namespacedconfigmapreplicas,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=replica.example.com,resources=namespacedconfigmapreplicas/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+
+func (r *NamespacedConfigMapReplicaReconciler) Reconcile(req ctrl.Request) (result ctrl.Result, err error) {
+	ctx := context.Background()
+	log := r.Log.WithValues("namespacedconfigmapreplica", req.NamespacedName)
+
+	configMapReplica := &replicav1alpha1.NamespacedConfigMapReplica{}
+	if err = r.Get(ctx, req.NamespacedName, configMapReplica); err != nil {
+		if errors.IsNotFound(err) {
+			r.sources.forget(req.NamespacedName)
+			err = nil
+		}
+		return
+	}
+
+	// making it editable
+	configMapReplica = configMapReplica.DeepCopy()
+
+	home := &corev1.Namespace{}
+	if err = r.Get(ctx, types.NamespacedName{Name: configMapReplica.Namespace}, home); err != nil {
+		log.Error(err, "getting replica namespace")
+		return
+	}
+	// copies live in other namespaces so they cannot be garbage collected
+	// using owner references. A finalizer applies the deletion policy to them
+	rep := &replication{
+		Client:  r.Client,
+		scheme:  r.Scheme,
+		log:     log,
+		owner:   configMapReplica,
+		spec:    &configMapReplica.Spec,
+		status:  &configMapReplica.Status,
+		inScope: tenantScope(home, r.tenantLabel()),
+	}
+	for _, ref := range configMapReplica.Spec.Clusters {
+		rep.remotes = append(rep.remotes, cluster{name: ref.Name, outOfScope: "remote clusters are only available to ConfigMapReplicas"})
+	}
+	result.RequeueAfter, err = rep.reconcile(ctx, req.NamespacedName, configMapReplica, reconcileOptions{
+		checkAccess:       r.CheckAccess,
+		protected:         r.ProtectedNamespaces,
+		maxChanges:        r.MaxChanges,
+		clusterQuota:      r.ClusterQuota,
+		revisionNamespace: configMapReplica.Namespace,
+		sources:           r.sources,
+		secrets:           r.secrets,
+	})
+	return
+}
+
+func (r *NamespacedConfigMapReplicaReconciler) tenantLabel() string {
+	if r.TenantLabel == "" {
+		return DefaultTenantLabel
+	}
+	return r.TenantLabel
+}
+
+// tenantScope only allows the replica namespace and namespaces
+// with the same tenant label value as the replica namespace
+func tenantScope(home *corev1.Namespace, label string) func(*corev1.Namespace) (bool, string) {
+	tenant := home.Labels[label]
+	return func(ns *corev1.Namespace) (bool, string) {
+		if ns.Name == home.Name || (tenant != "" && ns.Labels[label] == tenant) {
+			return true, ""
+		}
+		if tenant == "" {
+			return false, fmt.Sprintf("namespace %s has no %s label, only copies to itself are allowed", home.Name, label)
+		}
+		return false, fmt.Sprintf("namespace does not belong to tenant %s=%s", label, tenant)
+	}
+}
+
+// allReplicas enqueues all NamespacedConfigMapReplicas, used when a namespace
+// changes since its tenant may have changed, or when a ReplicationPolicy changes
+func (r *NamespacedConfigMapReplicaReconciler) allReplicas(obj handler.MapObject) []reconcile.Request {
+	list := &replicav1alpha1.NamespacedConfigMapReplicaList{}
+	if err := r.List(context.Background(), list); err != nil {
+		r.Log.Error(err, "listing namespacedconfigmapreplicas", "trigger", obj.Meta.GetName())
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(list.Items))
+	for _, item := range list.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: item.Namespace, Name: item.Name}})
+	}
+	return requests
+}
+
+// copyToReplica enqueues the replica owning a copy
+func (r *NamespacedConfigMapReplicaReconciler) copyToReplica(obj handler.MapObject) []reconcile.Request {
+	uid, ok := obj.Meta.GetLabels()[replicav1alpha1.OwnerUIDLabel]
+	if !ok {
+		return nil
+	}
+	list := &replicav1alpha1.NamespacedConfigMapReplicaList{}
+	if err := r.List(context.Background(), list); err != nil {
+		r.Log.Error(err, "listing namespacedconfigmapreplicas", "configmap", obj.Meta.GetName())
+		return nil
+	}
+	for _, item := range list.Items {
+		if string(item.UID) == uid {
+			return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: item.Namespace, Name: item.Name}}}
+		}
+	}
+	return nil
+}
+
+// consumerToReplica enqueues the replicas managing the copies a workload references
+func (r *NamespacedConfigMapReplicaReconciler) consumerToReplica(obj handler.MapObject) []reconcile.Request {
+	owners := copyOwners(r.Client, obj)
+	if len(owners) == 0 {
+		return nil
+	}
+	list := &replicav1alpha1.NamespacedConfigMapReplicaList{}
+	if err := r.List(context.Background(), list); err != nil {
+		r.Log.Error(err, "listing namespacedconfigmapreplicas", "consumer", obj.Meta.GetName())
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, item := range list.Items {
+		if owners[string(item.UID)] {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: item.Namespace, Name: item.Name}})
+		}
+	}
+	return requests
+}
+
+func (r *NamespacedConfigMapReplicaReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.Client = mgr.GetClient()
+	r.Scheme = mgr.GetScheme()
+	r.sources = newHTTPSources(mgr.GetAPIReader())
+	r.secrets = mgr.GetAPIReader()
+	if err := indexConsumers(mgr); err != nil {
+		return err
+	}
+	builder := ctrl.NewControllerManagedBy(mgr).
+		For(&replicav1alpha1.NamespacedConfigMapReplica{}).
+		Watches(&source.Kind{Type: &corev1.ConfigMap{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(r.copyToReplica),
+		}).
+		Watches(&source.Kind{Type: &corev1.Namespace{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(r.allReplicas),
+		}).
+		Watches(&source.Kind{Type: &replicav1alpha1.ReplicationPolicy{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(r.allReplicas),
+		})
+	for _, kind := range consumerKinds() {
+		builder = builder.Watches(&source.Kind{Type: kind}, consumerEvents(r.consumerToReplica))
+	}
+	return builder.Complete(r)
+}
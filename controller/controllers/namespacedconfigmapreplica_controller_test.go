@@ -0,0 +1,181 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	replicav1alpha1 "github.com/danielfbm/k8s-design-workshop/controller/api/v1alpha1"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	mgr "sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+var _ = Describe("NamespacedConfigMapReplica.Reconcile", func() {
+
+	var (
+		input, result *replicav1alpha1.NamespacedConfigMapReplica
+		namespaces    []*corev1.Namespace
+		// number of configmap statuses to be expected
+		expectedStatusNumber int
+		manager              ctrl.Manager
+		controller           *NamespacedConfigMapReplicaReconciler
+		opts                 mgr.Options
+		ctx                  context.Context
+		k8sclient            client.Client
+		err                  error
+		stop                 chan struct{}
+	)
+
+	BeforeEach(func() {
+		k8sclient = k8sClient
+		stop = make(chan struct{})
+		ctx = context.TODO()
+		namespaces = []*corev1.Namespace{}
+
+		manager, err = ctrl.NewManager(cfg, opts)
+		Expect(err).ToNot(HaveOccurred(), "building manager")
+		go func() {
+			Expect(manager.Start(stop)).ToNot(HaveOccurred(), "starting manager")
+		}()
+
+		controller = &NamespacedConfigMapReplicaReconciler{Log: logf.Log}
+		Expect(controller.SetupWithManager(manager)).To(Succeed(), "starting controller")
+	})
+
+	JustBeforeEach(func() {
+		for _, ns := range namespaces {
+			Expect(k8sclient.Create(ctx, ns)).To(Succeed(), "should create ns %s", ns.Name)
+		}
+
+		Expect(k8sclient.Create(ctx, input)).To(Succeed(), "should create a namespacedconfigmapreplica %s", input)
+
+		result = &replicav1alpha1.NamespacedConfigMapReplica{}
+		objKey := client.ObjectKey{Namespace: input.Namespace, Name: input.Name}
+		Eventually(func() int {
+			err = k8sclient.Get(ctx, objKey, result)
+			if err != nil {
+				return -1
+			}
+			return len(result.Status.ConfigMapStatuses)
+		},
+			time.Second,
+		).Should(Equal(expectedStatusNumber), "should have %d configmap statuses", expectedStatusNumber)
+	})
+
+	AfterEach(func() {
+		k8sclient.Delete(ctx, input)
+		close(stop)
+	})
+
+	Context("selected namespaces of the same and of another tenant", func() {
+		BeforeEach(func() {
+			namespaces = append(namespaces,
+				&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+					Name:   "tenant-a",
+					Labels: map[string]string{"tenant": "a"},
+				}},
+				&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+					Name:   "tenant-a-dev",
+					Labels: map[string]string{"tenant": "a", "environment": "dev"},
+				}},
+				&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+					Name:   "tenant-b-dev",
+					Labels: map[string]string{"tenant": "b", "environment": "dev"},
+				}},
+			)
+
+			input = &replicav1alpha1.NamespacedConfigMapReplica{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "replica",
+					Namespace: "tenant-a",
+				},
+				Spec: replicav1alpha1.ConfigMapReplicaSpec{
+					Template: replicav1alpha1.ConfigMapTemplate{
+						Data: map[string]string{"data.yaml": "some value for configmap"},
+					},
+					Selector: map[string]string{"environment": "dev"},
+				},
+			}
+			expectedStatusNumber = 2
+		})
+
+		It("should only copy to the namespace of the same tenant", func() {
+			copy := &corev1.ConfigMap{}
+			Expect(k8sclient.Get(ctx, client.ObjectKey{Namespace: "tenant-a-dev", Name: "replica"}, copy)).To(Succeed(), "should copy to tenant-a-dev")
+			Expect(copy.Data).To(Equal(input.Spec.Template.Data))
+
+			err = k8sclient.Get(ctx, client.ObjectKey{Namespace: "tenant-b-dev", Name: "replica"}, &corev1.ConfigMap{})
+			Expect(errors.IsNotFound(err)).To(BeTrue(), "should not copy to tenant-b-dev")
+
+			for _, status := range result.Status.ConfigMapStatuses {
+				switch status.Namespace {
+				case "tenant-a-dev":
+					Expect(status.Ready).To(BeTrue(), "copy in tenant-a-dev should be ready")
+				case "tenant-b-dev":
+					Expect(status.Ready).To(BeFalse(), "copy in tenant-b-dev should not be ready")
+					Expect(status.Reason).To(Equal(replicav1alpha1.ReasonOutOfScope))
+				default:
+					Fail("unexpected status for namespace " + status.Namespace)
+				}
+			}
+		})
+	})
+
+	Context("copies of both replica kinds in one namespace", func() {
+		var other *replicav1alpha1.ConfigMapReplica
+
+		BeforeEach(func() {
+			Expect((&ConfigMapReplicaReconciler{Log: logf.Log}).SetupWithManager(manager)).To(Succeed(), "starting controller")
+			namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:   "labels-home",
+				Labels: map[string]string{"labels": "both"},
+			}})
+			input = &replicav1alpha1.NamespacedConfigMapReplica{
+				ObjectMeta: metav1.ObjectMeta{Name: "namespaced-labels", Namespace: "labels-home"},
+				Spec: replicav1alpha1.ConfigMapReplicaSpec{
+					Template: replicav1alpha1.ConfigMapTemplate{
+						Data: map[string]string{"data.yaml": "namespaced"},
+					},
+					Selector: map[string]string{"labels": "both"},
+				},
+			}
+			// as the defaulting webhook does, the other replica is stored without it
+			input.Default()
+			other = &replicav1alpha1.ConfigMapReplica{
+				ObjectMeta: metav1.ObjectMeta{Name: "cluster-labels"},
+				Spec: replicav1alpha1.ConfigMapReplicaSpec{
+					Template: replicav1alpha1.ConfigMapTemplate{
+						Data: map[string]string{"data.yaml": "cluster"},
+					},
+					Selector: map[string]string{"labels": "both"},
+				},
+			}
+			expectedStatusNumber = 1
+		})
+
+		AfterEach(func() {
+			k8sclient.Delete(ctx, other)
+		})
+
+		It("should find every copy with the managed-by label", func() {
+			Expect(result.Spec.ConflictPolicy).To(Equal(replicav1alpha1.ConflictPolicySkip), "should store the defaults")
+			Expect(k8sclient.Create(ctx, other)).To(Succeed())
+
+			Eventually(func() []string {
+				list := &corev1.ConfigMapList{}
+				k8sclient.List(ctx, list, client.InNamespace("labels-home"), client.MatchingLabels{replicav1alpha1.ManagedByLabel: replicav1alpha1.ManagedByValue})
+				var names []string
+				for _, cm := range list.Items {
+					names = append(names, cm.Labels[replicav1alpha1.NameLabel])
+				}
+				return names
+			}, 5*time.Second).Should(ConsistOf("namespaced-labels", "cluster-labels"))
+		})
+	})
+})
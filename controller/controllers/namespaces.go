@@ -0,0 +1,20 @@
+package controllers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	replicav1alpha1 "github.com/danielfbm/k8s-design-workshop/controller/api/v1alpha1"
+)
+
+// DefaultProtectedNamespaces namespaces replicas only write to when listing them explicitly
+var DefaultProtectedNamespaces = []string{"kube-system", "kube-public", "kube-node-lease"}
+
+// targetNamespaces returns the namespaces a replica targets sorted by name. An empty
+// selector selects nothing unless allNamespaces is set, and protected namespaces
+// are only returned when listed in spec.namespaces
+func targetNamespaces(ctx context.Context, c client.Reader, spec *replicav1alpha1.ConfigMapReplicaSpec, protected []string) ([]corev1.Namespace, error) {
+	return replicav1alpha1.MatchingNamespaces(ctx, c, spec.Selector, spec.AllNamespaces, spec.Namespaces, protected)
+}
@@ -0,0 +1,220 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+
+	replicav1alpha1 "github.com/danielfbm/k8s-design-workshop/controller/api/v1alpha1"
+)
+
+// copyOperation a write to a copy
+type copyOperation string
+
+const (
+	operationCreate copyOperation = "create"
+	operationUpdate copyOperation = "update"
+	operationDelete copyOperation = "delete"
+	// operationRelease updates a copy so the replica no longer owns it
+	operationRelease copyOperation = "release"
+)
+
+// copyAction a write planned for one copy
+type copyAction struct {
+	operation copyOperation
+	// status index of the copy status the outcome is reported in, -1 for deletions.
+	// The shards of a copy report in the status of the copy
+	status int
+	// current copy, nil when creating
+	current *corev1.ConfigMap
+	// desired copy as it is written, nil when deleting
+	desired *corev1.ConfigMap
+}
+
+// object the ConfigMap the action writes
+func (a *copyAction) object() *corev1.ConfigMap {
+	if a.desired != nil {
+		return a.desired
+	}
+	return a.current
+}
+
+// clusterPlan the copy statuses and planned writes of one cluster
+type clusterPlan struct {
+	cluster cluster
+	log     logr.Logger
+	// statuses of all copies, those with an action are completed when it is applied
+	statuses []replicav1alpha1.ConfigMapReplicaCopy
+	actions  []copyAction
+	// namespaceLabels labels of the target namespaces, used to order rollouts
+	namespaceLabels map[string]map[string]string
+}
+
+// describe returns the action as shown to users, prefixed by the cluster when remote
+func (p *clusterPlan) describe(action *copyAction) string {
+	cm := action.object()
+	location := cm.Namespace + "/" + cm.Name
+	if !p.cluster.local() {
+		location = p.cluster.name + ":" + location
+	}
+	return fmt.Sprintf("%s %s", action.operation, location)
+}
+
+// replicationPlan everything a sync is about to write
+type replicationPlan struct {
+	clusters []*clusterPlan
+	// copyBytes data size of one copy, keys included
+	copyBytes int64
+	// revision of the data written to the copies
+	revision string
+	// shards number of shards the data is split across, 0 when it is not sharded
+	shards int
+}
+
+// usage returns the usage of the copies once the plan is applied,
+// counting the copies that are ready or about to be written
+func (p *replicationPlan) usage() replicav1alpha1.ReplicaUsage {
+	var copies int64
+	for _, cp := range p.clusters {
+		pending := make(map[int]bool, len(cp.actions))
+		for _, action := range cp.actions {
+			if action.status >= 0 {
+				pending[action.status] = true
+			}
+		}
+		for i, status := range cp.statuses {
+			if status.Ready || pending[i] {
+				copies++
+			}
+		}
+	}
+	return replicav1alpha1.ReplicaUsage{Copies: copies, Bytes: copies * p.copyBytes}
+}
+
+// changes returns the number of planned writes
+func (p *replicationPlan) changes() int {
+	count := 0
+	for _, cp := range p.clusters {
+		count += len(cp.actions)
+	}
+	return count
+}
+
+// describe lists up to max planned writes, all of them when max is negative
+func (p *replicationPlan) describe(max int) []string {
+	var descriptions []string
+	for _, cp := range p.clusters {
+		for i := range cp.actions {
+			if len(descriptions) == max {
+				return append(descriptions, fmt.Sprintf("and %d more", p.changes()-max))
+			}
+			descriptions = append(descriptions, cp.describe(&cp.actions[i]))
+		}
+	}
+	return descriptions
+}
+
+// maxPlannedChanges changes listed in the plan status
+const maxPlannedChanges = 100
+
+// report returns the plan as published in the status of a replica in Plan mode
+func (p *replicationPlan) report(generation int64) *replicav1alpha1.ReplicaPlan {
+	report := &replicav1alpha1.ReplicaPlan{ObservedGeneration: generation}
+	for _, cp := range p.clusters {
+		for i := range cp.actions {
+			if len(report.Changes) == maxPlannedChanges {
+				report.Omitted++
+				continue
+			}
+			action := &cp.actions[i]
+			cm := action.object()
+			change := replicav1alpha1.PlannedChange{
+				Operation: string(action.operation),
+				Cluster:   cp.cluster.name,
+				Namespace: cm.Namespace,
+				Name:      cm.Name,
+			}
+			var before, after map[string]string
+			if action.current != nil {
+				before = action.current.Data
+			}
+			if action.desired != nil {
+				after = action.desired.Data
+			}
+			change.Data = diffKeys(before, after)
+			report.Changes = append(report.Changes, change)
+		}
+	}
+	return report
+}
+
+// diffKeys lists the keys added, changed or removed going from before to after, sorted by key
+func diffKeys(before, after map[string]string) []replicav1alpha1.KeyChange {
+	var changes []replicav1alpha1.KeyChange
+	for k, v := range after {
+		old, ok := before[k]
+		switch {
+		case !ok:
+			changes = append(changes, replicav1alpha1.KeyChange{Key: k, Change: replicav1alpha1.KeyAdded})
+		case old != v:
+			changes = append(changes, replicav1alpha1.KeyChange{Key: k, Change: replicav1alpha1.KeyChanged})
+		}
+	}
+	for k := range before {
+		if _, ok := after[k]; !ok {
+			changes = append(changes, replicav1alpha1.KeyChange{Key: k, Change: replicav1alpha1.KeyRemoved})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes
+}
+
+// statuses returns the copy statuses of all clusters
+func (p *replicationPlan) statuses() []replicav1alpha1.ConfigMapReplicaCopy {
+	var statuses []replicav1alpha1.ConfigMapReplicaCopy
+	for _, cp := range p.clusters {
+		statuses = append(statuses, cp.statuses...)
+	}
+	return statuses
+}
+
+// apply makes all the planned writes and completes the copy statuses
+func (p *replicationPlan) apply(ctx context.Context) error {
+	var errs []error
+	for _, cp := range p.clusters {
+		for i := range cp.actions {
+			action := &cp.actions[i]
+			cp.log.Info("will "+string(action.operation)+" configmap", "configmap", action.object().ObjectMeta)
+			var err error
+			switch action.operation {
+			case operationCreate:
+				err = cp.cluster.Create(ctx, action.desired)
+			case operationUpdate, operationRelease:
+				err = cp.cluster.Update(ctx, action.desired)
+			case operationDelete:
+				if err = cp.cluster.Delete(ctx, action.current); errors.IsNotFound(err) {
+					err = nil
+				}
+			}
+			if err != nil {
+				errs = append(errs, err)
+			}
+			if action.status < 0 {
+				continue
+			}
+			// the shards of a copy report in its status, which is ready once all were written
+			status := &cp.statuses[action.status]
+			if err != nil {
+				status.Ready, status.Reason, status.Message = false, replicav1alpha1.ReasonSyncFailed, err.Error()
+			} else if status.Reason == "" {
+				status.Ready = true
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
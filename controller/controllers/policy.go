@@ -0,0 +1,109 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	replicav1alpha1 "github.com/danielfbm/k8s-design-workshop/controller/api/v1alpha1"
+)
+
+// +kubebuilder:rbac:groups=replica.example.com,resources=replicationpolicies,verbs=get;list;watch
+
+// policyDenial a ReplicationPolicy that does not allow a copy
+type policyDenial struct {
+	policy  string
+	message string
+}
+
+func (d *policyDenial) String() string {
+	return fmt.Sprintf("denied by ReplicationPolicy %s: %s", d.policy, d.message)
+}
+
+// matchingPolicies lists the ReplicationPolicies that apply to a replica
+func matchingPolicies(ctx context.Context, c client.Reader, replica metav1.Object) ([]replicav1alpha1.ReplicationPolicy, error) {
+	list := &replicav1alpha1.ReplicationPolicyList{}
+	if err := c.List(ctx, list); err != nil {
+		return nil, err
+	}
+	policies := make([]replicav1alpha1.ReplicationPolicy, 0, len(list.Items))
+	for _, policy := range list.Items {
+		spec := &policy.Spec
+		if len(spec.ReplicaNamespaces) > 0 && !containsString(spec.ReplicaNamespaces, replica.GetNamespace()) {
+			continue
+		}
+		ok, err := selectorMatches(spec.ReplicaSelector, replica.GetLabels())
+		if err != nil {
+			return nil, fmt.Errorf("ReplicationPolicy %s: %v", policy.Name, err)
+		}
+		if ok {
+			policies = append(policies, policy)
+		}
+	}
+	return policies, nil
+}
+
+// checkData returns the first policy that forbids the copy name or the size of the data
+// written, the template data with the decrypted and source data merged over it
+func checkData(policies []replicav1alpha1.ReplicationPolicy, name string, data map[string]string) *policyDenial {
+	size := dataSize(data)
+	for _, policy := range policies {
+		if containsString(policy.Spec.ReservedNames, name) {
+			return &policyDenial{policy: policy.Name, message: fmt.Sprintf("name %s is reserved", name)}
+		}
+		if max := policy.Spec.MaxDataSize; max != nil && int64(size) > max.Value() {
+			return &policyDenial{policy: policy.Name, message: fmt.Sprintf("data size %d exceeds the maximum of %s", size, max.String())}
+		}
+	}
+	return nil
+}
+
+// checkNamespace returns the first policy that forbids writing to a namespace
+func checkNamespace(policies []replicav1alpha1.ReplicationPolicy, ns *corev1.Namespace) *policyDenial {
+	for _, policy := range policies {
+		spec := &policy.Spec
+		if len(spec.TargetNamespaces) == 0 && spec.TargetNamespaceSelector == nil {
+			continue
+		}
+		if containsString(spec.TargetNamespaces, ns.Name) {
+			continue
+		}
+		if spec.TargetNamespaceSelector != nil {
+			ok, err := selectorMatches(spec.TargetNamespaceSelector, ns.Labels)
+			if err != nil {
+				return &policyDenial{policy: policy.Name, message: err.Error()}
+			}
+			if ok {
+				continue
+			}
+		}
+		return &policyDenial{policy: policy.Name, message: fmt.Sprintf("namespace %s is not an allowed target", ns.Name)}
+	}
+	return nil
+}
+
+// allowsProtected returns true when a policy allows writing to a protected namespace
+func allowsProtected(policies []replicav1alpha1.ReplicationPolicy, namespace string) bool {
+	for _, policy := range policies {
+		if containsString(policy.Spec.ProtectedNamespaces, namespace) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectorMatches like metav1.LabelSelectorAsSelector but a nil selector matches everything
+func selectorMatches(selector *metav1.LabelSelector, set map[string]string) (bool, error) {
+	if selector == nil {
+		return true, nil
+	}
+	s, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return false, err
+	}
+	return s.Matches(labels.Set(set)), nil
+}
@@ -0,0 +1,39 @@
+package controllers
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+
+	replicav1alpha1 "github.com/danielfbm/k8s-design-workshop/controller/api/v1alpha1"
+)
+
+// withinQuota returns false when the plan makes the copies exceed the replica or
+// cluster quota, setting the QuotaExceeded condition. Plans that do not grow
+// the usage are always allowed so an over quota replica can still shrink
+func (r *replication) withinQuota(plan *replicationPlan) bool {
+	usage := plan.usage()
+	err := r.spec.Quota.Exceeds(usage)
+	if err == nil {
+		if err = r.clusterQuota.Exceeds(usage.Add(r.otherUsage)); err != nil {
+			err = fmt.Errorf("cluster quota: %v", err)
+		}
+	}
+	if err == nil || (usage.Copies <= r.status.Usage.Copies && usage.Bytes <= r.status.Usage.Bytes) {
+		removeCondition(r.status, replicav1alpha1.ConditionQuotaExceeded)
+		return true
+	}
+
+	r.log.Info("quota exceeded", "reason", err.Error())
+	setCondition(r.status, replicav1alpha1.ConditionQuotaExceeded, corev1.ConditionTrue, "QuotaExceeded", err.Error())
+	return false
+}
+
+// dataSize size of ConfigMap data, keys included
+func dataSize(data map[string]string) int {
+	size := 0
+	for k, v := range data {
+		size += len(k) + len(v)
+	}
+	return size
+}
@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	replicav1alpha1 "github.com/danielfbm/k8s-design-workshop/controller/api/v1alpha1"
+)
+
+// reconcileOptions controller settings both replica kinds are reconciled with
+type reconcileOptions struct {
+	// checkAccess only writes copies where the replica subject may write ConfigMaps
+	checkAccess bool
+	// protected namespaces only written to when listed and allowed by a policy
+	protected []string
+	// maxChanges writes a sync may make without approval, replicas can only lower it
+	maxChanges int
+	// clusterQuota limits the copies of all replicas together, nil means no limit
+	clusterQuota *replicav1alpha1.ReplicaQuota
+	// revisionNamespace namespace the template revisions are stored in
+	revisionNamespace string
+	sources           *httpSources
+	secrets           client.Reader
+}
+
+// reconcile runs the flow shared by both replica kinds for the replica object, which owns the
+// spec and status of the replication: the finalizer applying the deletion policy, the template
+// rollback and history, the quota, access and policy checks, the source, decryption and validation
+// of the data, the sync and the status update. It returns how long until the replica should be
+// reconciled again, 0 when it only needs to be on changes
+func (r *replication) reconcile(ctx context.Context, replica types.NamespacedName, object runtime.Object, opts reconcileOptions) (time.Duration, error) {
+	previous := r.status.DeepCopy()
+
+	// the finalizer applies the deletion policy to copies in all clusters, local copies
+	// would otherwise be garbage collected or, in other namespaces, left behind
+	if !r.owner.GetDeletionTimestamp().IsZero() {
+		if !containsString(r.owner.GetFinalizers(), copiesFinalizer) {
+			return 0, nil
+		}
+		// the progress is reported before the finalizer is removed
+		err := r.finalize(ctx)
+		if updateErr := r.Status().Update(ctx, object); updateErr != nil && err == nil {
+			err = updateErr
+		}
+		if err != nil {
+			r.log.Error(err, "applying deletion policy to copies")
+			return 0, err
+		}
+		r.owner.SetFinalizers(removeString(r.owner.GetFinalizers(), copiesFinalizer))
+		return 0, r.Update(ctx, object)
+	}
+	if !containsString(r.owner.GetFinalizers(), copiesFinalizer) {
+		r.owner.SetFinalizers(append(r.owner.GetFinalizers(), copiesFinalizer))
+		if err := r.Update(ctx, object); err != nil {
+			return 0, err
+		}
+	}
+
+	// a restored template is written first, the update triggers the sync
+	r.history = &revisionHistory{Client: r.Client, scheme: r.scheme, owner: r.owner, namespace: opts.revisionNamespace}
+	restored, err := r.history.rollback(ctx, r.spec, r.status)
+	if err != nil || restored {
+		if err == nil {
+			err = r.Update(ctx, object)
+		}
+		return 0, err
+	}
+	if r.status.UpdateRevision, err = r.history.record(ctx, &r.spec.Template, r.spec.RevisionHistoryLimit, r.status.CurrentRevision); err != nil {
+		r.log.Error(err, "recording template revision")
+		return 0, err
+	}
+
+	r.secrets = opts.secrets
+	r.protected = opts.protected
+	r.maxChanges = maxChanges(opts.maxChanges, r.spec)
+	if opts.clusterQuota != nil {
+		r.clusterQuota = opts.clusterQuota
+		if r.otherUsage, err = replicav1alpha1.ClusterUsage(ctx, r, r.owner.GetUID()); err != nil {
+			r.log.Error(err, "summing usage of other replicas")
+			return 0, err
+		}
+	}
+	if opts.checkAccess {
+		r.access = newAccessReview(r.owner, r.spec)
+	}
+	if r.policies, err = matchingPolicies(ctx, r, r.owner); err != nil {
+		r.log.Error(err, "listing replication policies")
+		return 0, err
+	}
+
+	// without a good source document, decrypted data or valid data existing copies are left untouched
+	next, ok := opts.sources.syncSource(ctx, replica, r)
+	if ok && decryptTemplate(ctx, opts.secrets, replica, r) && validateData(ctx, r.Client, replica, r) {
+		if err = r.sync(ctx); err == nil {
+			synced(r.status)
+		}
+	}
+	if r.requeueAfter > 0 && (next == 0 || next > r.requeueAfter) {
+		next = r.requeueAfter
+	}
+	// remote clusters are not watched
+	for _, cl := range r.remotes {
+		if cl.outOfScope == "" && (next == 0 || next > remoteResyncPeriod) {
+			next = remoteResyncPeriod
+		}
+	}
+
+	if statusChanged(previous, r.status) {
+		if updateErr := r.Status().Update(ctx, object); updateErr != nil {
+			r.log.Error(updateErr, "updating status")
+			if err == nil {
+				err = updateErr
+			}
+		}
+	}
+	return next, err
+}
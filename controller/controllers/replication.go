@@ -0,0 +1,551 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	replicav1alpha1 "github.com/danielfbm/k8s-design-workshop/controller/api/v1alpha1"
+)
+
+// replication syncs the copies of one replica. It is shared between
+// ConfigMapReplica and NamespacedConfigMapReplica, which only differ
+// on which namespaces they may write to and how copies are owned
+type replication struct {
+	// Client of the cluster the replica lives in
+	client.Client
+	scheme *runtime.Scheme
+	log    logr.Logger
+
+	// owner is the replica object
+	owner  metav1.Object
+	spec   *replicav1alpha1.ConfigMapReplicaSpec
+	status *replicav1alpha1.ConfigMapReplicaStatus
+
+	// controller sets the replica as the controller owner reference of its copies
+	controller bool
+	// inScope returns false and a message when the replica may not write to a namespace
+	// nil means all selected namespaces are in scope
+	inScope func(ns *corev1.Namespace) (bool, string)
+	// policies ReplicationPolicies matching the replica
+	policies []replicav1alpha1.ReplicationPolicy
+	// remotes remote clusters the replica also writes to
+	remotes []cluster
+	// decrypted plaintext of the encrypted template data, merged over the template data
+	decrypted map[string]string
+	// sourceData data fetched from the replica source, merged over the template data
+	sourceData map[string]string
+	// protected namespaces only written to when listed in spec.namespaces and allowed by a policy
+	protected []string
+	// maxChanges writes a sync may make without approval, 0 means no limit
+	maxChanges int
+	// clusterQuota limits the copies of all replicas together, nil means no limit
+	clusterQuota *replicav1alpha1.ReplicaQuota
+	// otherUsage usage of all other replicas, counted against clusterQuota
+	otherUsage replicav1alpha1.ReplicaUsage
+	// requeueAfter set by sync when it waits for time to pass, 0 when it does not
+	requeueAfter time.Duration
+	// access checks the replica may write to namespaces of the local cluster, nil skips the checks.
+	// Remote clusters are written with the identity of their kubeconfig, which the replica
+	// may only use when allowed to read its Secret
+	access *accessReview
+	// history template revisions of the replica, used to revert failed rollouts
+	history *revisionHistory
+	// secrets reads the decryption Secret without caching Secrets in the manager
+	secrets client.Reader
+}
+
+// copyResult outcome of syncing one copy
+type copyResult struct {
+	ready   bool
+	reason  string
+	message string
+}
+
+// sync creates or updates a copy in every selected namespace of every cluster,
+// removes copies from namespaces no longer targeted and updates the copy statuses.
+// All writes are planned first. In Plan mode they are only reported in the status,
+// a suspended replica only reports the copies it would write, otherwise updates outside
+// the current rollout wave and writes outside the maintenance windows are held back and
+// nothing is written when the rest exceeds the quota or the blast radius.
+// A remote cluster failing does not stop the others from being synced
+func (r *replication) sync(ctx context.Context) error {
+	plan, err := r.plan(ctx)
+	if plan == nil {
+		return err
+	}
+	if !r.spec.Suspend {
+		removeCondition(r.status, replicav1alpha1.ConditionSuspended)
+	} else {
+		setCondition(r.status, replicav1alpha1.ConditionSuspended, corev1.ConditionTrue, "Suspended",
+			fmt.Sprintf("replication is suspended, %d writes are held", plan.changes()))
+	}
+	if r.spec.Mode == replicav1alpha1.ReplicaModePlan {
+		r.status.Plan = plan.report(r.owner.GetGeneration())
+		return err
+	}
+	r.status.Plan = nil
+	if r.spec.Suspend {
+		if trackErr := r.trackConsumers(ctx, plan); trackErr != nil {
+			err = utilerrors.NewAggregate([]error{err, trackErr})
+		}
+		r.status.ConfigMapStatuses = mergeCopyStatuses(r.status.ConfigMapStatuses, r.suspendedStatuses(plan))
+		r.status.Consumers = countConsumers(r.status.ConfigMapStatuses)
+		return err
+	}
+	r.requeueAfter = r.stageRollout(ctx, plan)
+	if wait := r.withinWindows(ctx, plan); wait > 0 && (r.requeueAfter == 0 || wait < r.requeueAfter) {
+		r.requeueAfter = wait
+	}
+	if !r.withinQuota(plan) || !r.withinBlastRadius(plan) {
+		return err
+	}
+	applyErr := plan.apply(ctx)
+	if r.spec.RolloutConsumers {
+		if err := r.rolloutConsumers(ctx, plan); err != nil {
+			applyErr = utilerrors.NewAggregate([]error{applyErr, err})
+		}
+	}
+	if err := r.trackConsumers(ctx, plan); err != nil {
+		applyErr = utilerrors.NewAggregate([]error{applyErr, err})
+	}
+	r.status.ConfigMapStatuses = mergeCopyStatuses(r.status.ConfigMapStatuses, plan.statuses())
+	r.status.Consumers = countConsumers(r.status.ConfigMapStatuses)
+	r.status.Usage = plan.usage()
+	return utilerrors.NewAggregate([]error{err, applyErr})
+}
+
+// plan computes the copy statuses and the writes needed in every cluster
+func (r *replication) plan(ctx context.Context) (*replicationPlan, error) {
+	base, err := r.baseConfigMap()
+	if err != nil {
+		r.log.Error(err, "base", base, "owner", r.owner)
+		return nil, err
+	}
+
+	// a denied name or data size applies to all copies
+	templateDenial := checkData(r.policies, base.Name, base.Data)
+
+	copyBytes := int64(dataSize(base.Data))
+	shards, err := r.shardBase(base)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	plan := &replicationPlan{
+		copyBytes: copyBytes,
+		revision:  shortRevision(base.Annotations[replicav1alpha1.ContentHashAnnotation]),
+		shards:    len(shards),
+	}
+	for _, cl := range r.clusters() {
+		cp, err := r.planCluster(ctx, cl, base, shards, templateDenial)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if cp != nil {
+			plan.clusters = append(plan.clusters, cp)
+		}
+	}
+	return plan, utilerrors.NewAggregate(errs)
+}
+
+// clusters returns the local cluster followed by the remote clusters
+func (r *replication) clusters() []cluster {
+	return append([]cluster{{Client: r.Client}}, r.remotes...)
+}
+
+// planCluster plans the copies in one cluster. The shards of a copy are written with it
+func (r *replication) planCluster(ctx context.Context, cl cluster, base *corev1.ConfigMap, shards []*corev1.ConfigMap, templateDenial *policyDenial) (*clusterPlan, error) {
+	cp := &clusterPlan{cluster: cl, log: r.log}
+	if cl.outOfScope != "" {
+		cp.statuses = []replicav1alpha1.ConfigMapReplicaCopy{{
+			Cluster: cl.name,
+			Name:    base.Name,
+			Reason:  replicav1alpha1.ReasonOutOfScope,
+			Message: cl.outOfScope,
+		}}
+		return cp, nil
+	}
+	if cl.forbidden != "" {
+		cp.statuses = []replicav1alpha1.ConfigMapReplicaCopy{{
+			Cluster: cl.name,
+			Name:    base.Name,
+			Reason:  replicav1alpha1.ReasonForbidden,
+			Message: "kubeconfig: " + cl.forbidden,
+		}}
+		return cp, nil
+	}
+	if cl.err != nil {
+		cp.statuses = []replicav1alpha1.ConfigMapReplicaCopy{unreachableCopy(cl.name, base.Name, cl.err)}
+		return cp, nil
+	}
+	if !cl.local() {
+		cp.log = cp.log.WithValues("cluster", cl.name)
+		base, shards = remoteCopies(base, shards)
+	}
+	names := map[string]bool{base.Name: true}
+	for _, shard := range shards {
+		names[shard.Name] = true
+	}
+
+	namespaces, err := targetNamespaces(ctx, cl, r.spec, r.protected)
+	if err != nil {
+		cp.log.Error(err, "listing namespaces", "selector", r.spec.Selector)
+		if !cl.local() {
+			cp.statuses = []replicav1alpha1.ConfigMapReplicaCopy{unreachableCopy(cl.name, base.Name, err)}
+			return cp, nil
+		}
+		return nil, err
+	}
+
+	var errs []error
+	targets := make(map[string]bool, len(namespaces))
+	cp.statuses = make([]replicav1alpha1.ConfigMapReplicaCopy, 0, len(namespaces))
+	cp.namespaceLabels = make(map[string]map[string]string, len(namespaces))
+	for i := range namespaces {
+		ns := &namespaces[i]
+		result := copyResult{}
+		var actions []copyAction
+		denial := templateDenial
+		if denial == nil {
+			denial = checkNamespace(r.policies, ns)
+		}
+		if r.inScope != nil {
+			if ok, message := r.inScope(ns); !ok {
+				result = copyResult{reason: replicav1alpha1.ReasonOutOfScope, message: message}
+			}
+		}
+		if result.reason == "" && containsString(r.protected, ns.Name) && !allowsProtected(r.policies, ns.Name) {
+			result = copyResult{reason: replicav1alpha1.ReasonPolicyDenied, message: fmt.Sprintf("namespace %s is protected and no ReplicationPolicy allows it", ns.Name)}
+		}
+		if result.reason == "" && denial == nil && cl.local() && r.access != nil {
+			forbidden, err := r.access.check(ctx, r.Client, ns.Name)
+			switch {
+			case err != nil:
+				// keep the copy until the check succeeds again
+				targets[ns.Name] = true
+				errs = append(errs, err)
+				result = copyResult{reason: replicav1alpha1.ReasonSyncFailed, message: err.Error()}
+			case forbidden != "":
+				result = copyResult{reason: replicav1alpha1.ReasonForbidden, message: forbidden}
+			}
+		}
+		switch {
+		case result.reason != "":
+		case denial != nil:
+			result = copyResult{reason: replicav1alpha1.ReasonPolicyDenied, message: denial.String()}
+		default:
+			targets[ns.Name] = true
+			if result, actions, err = r.planShardedCopy(ctx, cl, cp.log, base, shards, ns.Name); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		status := replicav1alpha1.ConfigMapReplicaCopy{
+			Cluster:   cl.name,
+			Name:      base.Name,
+			Namespace: ns.Name,
+			Ready:     result.ready,
+			Reason:    result.reason,
+			Message:   result.message,
+		}
+		for _, action := range actions {
+			action.status = len(cp.statuses)
+			cp.actions = append(cp.actions, action)
+		}
+		if result.ready || len(actions) > 0 {
+			status.Revision = shortRevision(base.Annotations[replicav1alpha1.ContentHashAnnotation])
+		}
+		cp.statuses = append(cp.statuses, status)
+		cp.namespaceLabels[ns.Name] = ns.Labels
+	}
+
+	if err := r.planPrune(ctx, cp, names, targets); err != nil {
+		errs = append(errs, err)
+	}
+	return cp, utilerrors.NewAggregate(errs)
+}
+
+// remoteCopies returns base and shards without owner references, which cannot point to
+// another cluster. Copies in remote clusters are found by label instead
+func remoteCopies(base *corev1.ConfigMap, shards []*corev1.ConfigMap) (*corev1.ConfigMap, []*corev1.ConfigMap) {
+	base = base.DeepCopy()
+	base.OwnerReferences = nil
+	remote := make([]*corev1.ConfigMap, len(shards))
+	for i := range shards {
+		remote[i] = shards[i].DeepCopy()
+		remote[i].OwnerReferences = nil
+	}
+	return base, remote
+}
+
+// unreachableCopy status reported in place of the copies of a cluster that could not be reached
+func unreachableCopy(cluster, name string, err error) replicav1alpha1.ConfigMapReplicaCopy {
+	return replicav1alpha1.ConfigMapReplicaCopy{
+		Cluster: cluster,
+		Name:    name,
+		Reason:  replicav1alpha1.ReasonClusterUnreachable,
+		Message: err.Error(),
+	}
+}
+
+// baseConfigMap builds the ConfigMap all copies are cloned from
+func (r *replication) baseConfigMap() (*corev1.ConfigMap, error) {
+	labels := make(map[string]string, len(r.spec.Template.Labels)+3)
+	for k, v := range r.spec.Template.Labels {
+		labels[k] = v
+	}
+	// set by the defaulting webhooks too, replicas stored without them still label their copies
+	labels[replicav1alpha1.ManagedByLabel] = replicav1alpha1.ManagedByValue
+	labels[replicav1alpha1.NameLabel] = r.owner.GetName()
+	labels[replicav1alpha1.OwnerUIDLabel] = string(r.owner.GetUID())
+
+	name := r.spec.Template.Name
+	if name == "" {
+		name = r.owner.GetName()
+	}
+	data := r.data()
+	base := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Labels:      labels,
+			Annotations: map[string]string{replicav1alpha1.ContentHashAnnotation: contentHash(data)},
+		},
+		Data: data,
+	}
+	if r.controller {
+		if err := controllerutil.SetControllerReference(r.owner, base, r.scheme); err != nil {
+			return base, err
+		}
+	}
+	return base, nil
+}
+
+// data returns the data of the copies, the template data with the decrypted and source data merged over it
+func (r *replication) data() map[string]string {
+	if len(r.decrypted) == 0 && len(r.sourceData) == 0 {
+		return r.spec.Template.Data
+	}
+	data := make(map[string]string, len(r.spec.Template.Data)+len(r.decrypted)+len(r.sourceData))
+	for _, layer := range []map[string]string{r.spec.Template.Data, r.decrypted, r.sourceData} {
+		for k, v := range layer {
+			data[k] = v
+		}
+	}
+	return data
+}
+
+// planShardedCopy plans the copy in a namespace along with its shards, which are written first
+// so the index never lists a missing shard. No action is returned when one of them may not be written
+func (r *replication) planShardedCopy(ctx context.Context, c client.Client, log logr.Logger, base *corev1.ConfigMap, shards []*corev1.ConfigMap, namespace string) (copyResult, []copyAction, error) {
+	var actions []copyAction
+	for _, cm := range append(append([]*corev1.ConfigMap{}, shards...), base) {
+		result, action, err := r.planCopy(ctx, c, log, cm, namespace)
+		if err != nil || result.reason != "" {
+			if len(shards) > 0 && cm != base {
+				result.message = cm.Name + ": " + result.message
+			}
+			return result, nil, err
+		}
+		if action != nil {
+			actions = append(actions, *action)
+		}
+	}
+	return copyResult{ready: len(actions) == 0}, actions, nil
+}
+
+// planCopy plans creating the copy in a namespace or updating it when it differs from base.
+// No action is returned when the copy is up to date or may not be written
+func (r *replication) planCopy(ctx context.Context, c client.Client, log logr.Logger, base *corev1.ConfigMap, namespace string) (copyResult, *copyAction, error) {
+	clone := base.DeepCopy()
+	clone.Namespace = namespace
+
+	current := &corev1.ConfigMap{}
+	err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: clone.Name}, current)
+	switch {
+	// no item, we can create
+	case errors.IsNotFound(err):
+		return copyResult{}, &copyAction{operation: operationCreate, desired: clone}, nil
+	case err != nil:
+		return copyResult{reason: replicav1alpha1.ReasonSyncFailed, message: err.Error()}, nil, err
+	}
+
+	// item exist but we should never touch what is not ours unless asked to adopt it
+	managed := r.manages(current)
+	if !managed {
+		if r.spec.ConflictPolicy != replicav1alpha1.ConflictPolicyAdopt {
+			return copyResult{reason: replicav1alpha1.ReasonConflict, message: "configmap exists and is not managed by this replica"}, nil, nil
+		}
+		if owner := metav1.GetControllerOf(current); owner != nil {
+			return copyResult{reason: replicav1alpha1.ReasonConflict, message: fmt.Sprintf("configmap is controlled by %s %s and cannot be adopted", owner.Kind, owner.Name)}, nil, nil
+		}
+		log.Info("will adopt configmap", "configmap", clone.ObjectMeta)
+	} else if r.drifted(current) && r.spec.DriftPolicy == replicav1alpha1.DriftPolicyReport {
+		return copyResult{reason: replicav1alpha1.ReasonDrifted, message: "configmap was changed outside the replica"}, nil, nil
+	}
+	if managed && equality.Semantic.DeepEqual(current.Data, clone.Data) && equality.Semantic.DeepEqual(current.Labels, clone.Labels) &&
+		current.Annotations[replicav1alpha1.ContentHashAnnotation] == clone.Annotations[replicav1alpha1.ContentHashAnnotation] {
+		return copyResult{ready: true}, nil, nil
+	}
+
+	desired := current.DeepCopy()
+	desired.Labels = clone.Labels
+	desired.Data = clone.Data
+	if desired.Annotations == nil {
+		desired.Annotations = map[string]string{}
+	}
+	desired.Annotations[replicav1alpha1.ContentHashAnnotation] = clone.Annotations[replicav1alpha1.ContentHashAnnotation]
+	if len(clone.OwnerReferences) > 0 {
+		// other owners of an adopted copy are kept, the replica becomes its controller
+		desired.OwnerReferences = nil
+		for _, ref := range current.OwnerReferences {
+			if (ref.Controller == nil || !*ref.Controller) && ref.UID != r.owner.GetUID() {
+				desired.OwnerReferences = append(desired.OwnerReferences, ref)
+			}
+		}
+		desired.OwnerReferences = append(desired.OwnerReferences, clone.OwnerReferences...)
+	}
+	return copyResult{}, &copyAction{operation: operationUpdate, current: current, desired: desired}, nil
+}
+
+// drifted returns true when the data of a copy is not what the replica last wrote to it.
+// Copies written before the content hash was recorded are never considered drifted
+func (r *replication) drifted(cm *corev1.ConfigMap) bool {
+	hash, ok := cm.Annotations[replicav1alpha1.ContentHashAnnotation]
+	return ok && hash != contentHash(cm.Data)
+}
+
+// contentHash hash of ConfigMap data, independent of the key order
+func contentHash(data map[string]string) string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	hash := sha256.New()
+	for _, k := range keys {
+		fmt.Fprintf(hash, "%d:%s%d:%s", len(k), k, len(data[k]), data[k])
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// manages returns true when the ConfigMap is a copy of the replica
+func (r *replication) manages(cm *corev1.ConfigMap) bool {
+	return cm.Labels[replicav1alpha1.OwnerUIDLabel] == string(r.owner.GetUID()) || metav1.IsControlledBy(cm, r.owner)
+}
+
+// copies lists all copies of the replica across namespaces
+func (r *replication) copies(ctx context.Context, c client.Client) ([]corev1.ConfigMap, error) {
+	list := &corev1.ConfigMapList{}
+	err := c.List(ctx, list, client.MatchingLabels{replicav1alpha1.OwnerUIDLabel: string(r.owner.GetUID())})
+	return list.Items, err
+}
+
+// planPrune plans deleting copies that are not named one of names, such as shards left over when
+// the data shrank, or live outside the target namespaces.
+// Copies still referenced by workloads are kept with an InUse status unless pruning is forced
+func (r *replication) planPrune(ctx context.Context, cp *clusterPlan, names map[string]bool, targets map[string]bool) error {
+	copies, err := r.copies(ctx, cp.cluster)
+	if err != nil {
+		return err
+	}
+	// shards listed by the index of a copy are kept while it lists them,
+	// such as those of a copy held back or reverted to a previous revision
+	indexed := map[string]bool{}
+	for i := range copies {
+		if names[copies[i].Name] {
+			for _, shard := range indexedShards(&copies[i]) {
+				indexed[copies[i].Namespace+"/"+shard] = true
+			}
+		}
+	}
+	force := r.forcePrune()
+	for i := range copies {
+		cm := &copies[i]
+		if (names[cm.Name] || indexed[cm.Namespace+"/"+cm.Name]) && targets[cm.Namespace] {
+			continue
+		}
+		if !force {
+			found, err := consumers(ctx, &cp.cluster, cm.Namespace, cm.Name)
+			if err != nil {
+				return err
+			}
+			if len(found) > 0 {
+				cp.log.Info("deferring deletion of configmap in use", "configmap", cm.ObjectMeta, "consumers", found)
+				cp.statuses = append(cp.statuses, inUseCopy(cp.cluster.name, cm, found))
+				continue
+			}
+		}
+		cp.actions = append(cp.actions, copyAction{operation: operationDelete, status: -1, current: cm})
+	}
+	return nil
+}
+
+// mergeCopyStatuses sets the probe and transition times of the current statuses
+// keeping the transition time of copies that did not change
+func mergeCopyStatuses(previous, current []replicav1alpha1.ConfigMapReplicaCopy) []replicav1alpha1.ConfigMapReplicaCopy {
+	now := metav1.Now()
+	statuses := make([]replicav1alpha1.ConfigMapReplicaCopy, 0, len(current))
+	for _, status := range current {
+		status.LastProbeTime = now
+		status.LastTransitionTime = now
+		for _, old := range previous {
+			if old.Cluster == status.Cluster && old.Name == status.Name && old.Namespace == status.Namespace && old.Ready == status.Ready {
+				status.LastTransitionTime = old.LastTransitionTime
+				break
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// copyStatusesChanged compares copy statuses ignoring probe times, which change on every sync
+func copyStatusesChanged(a, b []replicav1alpha1.ConfigMapReplicaCopy) bool {
+	if len(a) != len(b) {
+		return true
+	}
+	for i := range a {
+		x, y := a[i], b[i]
+		x.LastProbeTime, y.LastProbeTime = metav1.Time{}, metav1.Time{}
+		if !equality.Semantic.DeepEqual(x, y) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsString returns true if s is in slice
+func containsString(slice []string, s string) bool {
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// removeString returns slice without s
+func removeString(slice []string, s string) (result []string) {
+	for _, item := range slice {
+		if item == s {
+			continue
+		}
+		result = append(result, item)
+	}
+	return
+}
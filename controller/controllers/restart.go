@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	replicav1alpha1 "github.com/danielfbm/k8s-design-workshop/controller/api/v1alpha1"
+)
+
+// +kubebuilder:rbac:groups=apps,resources=deployments;statefulsets;daemonsets,verbs=patch
+
+// consumerHashAnnotation pod template annotation holding the content hash of the copy name.
+// Names too long for an annotation key, whose name part has the length limit of a label
+// value, are shortened with a hash of the name
+func consumerHashAnnotation(name string) string {
+	maxName := validation.LabelValueMaxLength - len("configmap-")
+	if len(name) > maxName {
+		sum := sha256.Sum256([]byte(name))
+		name = name[:maxName-11] + "-" + hex.EncodeToString(sum[:])[:10]
+	}
+	return replicav1alpha1.ConsumerHashAnnotationPrefix + name
+}
+
+// rolloutConsumers sets the consumer hash annotation on the pod templates of the workloads
+// referencing each copy the plan created or updated, which makes them roll out their pods.
+// In the local cluster only workloads the replica subject may patch are rolled out, the
+// others are listed in the message of the copy status. Remote clusters are written with
+// the identity of their kubeconfig
+func (r *replication) rolloutConsumers(ctx context.Context, plan *replicationPlan) error {
+	var errs []error
+	for _, cp := range plan.clusters {
+		var access *accessReview
+		if cp.cluster.local() {
+			access = newAccessReview(r.owner, r.spec)
+		}
+		for _, action := range cp.actions {
+			if action.status < 0 || !cp.statuses[action.status].Ready {
+				continue
+			}
+			cm := action.desired
+			hash := cm.Annotations[replicav1alpha1.ContentHashAnnotation]
+			if action.current != nil && action.current.Annotations[replicav1alpha1.ContentHashAnnotation] == hash {
+				continue
+			}
+			forbidden, err := r.restartConsumers(ctx, cp, access, cm.Namespace, cm.Name, hash)
+			if err != nil {
+				errs = append(errs, err)
+			}
+			if len(forbidden) > 0 {
+				cp.statuses[action.status].Message = "consumers not rolled out: " + strings.Join(forbidden, "; ")
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// restartConsumers annotates the pod template of the Deployments, StatefulSets and DaemonSets
+// in namespace referencing the ConfigMap name with its content hash. Unless access is nil, kinds
+// the user may not patch are skipped and why is returned
+func (r *replication) restartConsumers(ctx context.Context, cp *clusterPlan, access *accessReview, namespace, name, hash string) ([]string, error) {
+	key := consumerHashAnnotation(name)
+	// denied why each kind may not be patched, only checked once a consumer of that kind is found
+	denied := map[string]string{}
+	var forbidden []string
+	patch := func(obj runtime.Object, resource, consumer string, template *corev1.PodTemplateSpec) error {
+		if !referencesConfigMap(&template.Spec, name) || template.Annotations[key] == hash {
+			return nil
+		}
+		if access != nil {
+			reason, checked := denied[resource]
+			if !checked {
+				var err error
+				if reason, err = access.allowed(ctx, r.Client, namespace, "patch", appsv1.Resource(resource)); err != nil {
+					return err
+				}
+				denied[resource] = reason
+				if reason != "" {
+					forbidden = append(forbidden, reason)
+				}
+			}
+			if reason != "" {
+				cp.log.Info("not rolling out consumer", "namespace", namespace, "configmap", name, "consumer", consumer, "reason", reason)
+				return nil
+			}
+		}
+		original := obj.DeepCopyObject()
+		if template.Annotations == nil {
+			template.Annotations = map[string]string{}
+		}
+		template.Annotations[key] = hash
+		cp.log.Info("rolling out consumer", "namespace", namespace, "configmap", name, "consumer", consumer)
+		return cp.cluster.Patch(ctx, obj, client.MergeFrom(original))
+	}
+
+	var errs []error
+	deployments := &appsv1.DeploymentList{}
+	if err := cp.cluster.List(ctx, deployments, client.InNamespace(namespace)); err != nil {
+		return forbidden, err
+	}
+	for i := range deployments.Items {
+		if err := patch(&deployments.Items[i], "deployments", "Deployment/"+deployments.Items[i].Name, &deployments.Items[i].Spec.Template); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	statefulSets := &appsv1.StatefulSetList{}
+	if err := cp.cluster.List(ctx, statefulSets, client.InNamespace(namespace)); err != nil {
+		return forbidden, err
+	}
+	for i := range statefulSets.Items {
+		if err := patch(&statefulSets.Items[i], "statefulsets", "StatefulSet/"+statefulSets.Items[i].Name, &statefulSets.Items[i].Spec.Template); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	daemonSets := &appsv1.DaemonSetList{}
+	if err := cp.cluster.List(ctx, daemonSets, client.InNamespace(namespace)); err != nil {
+		return forbidden, err
+	}
+	for i := range daemonSets.Items {
+		if err := patch(&daemonSets.Items[i], "daemonsets", "DaemonSet/"+daemonSets.Items[i].Name, &daemonSets.Items[i].Spec.Template); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return forbidden, utilerrors.NewAggregate(errs)
+}
@@ -0,0 +1,217 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	replicav1alpha1 "github.com/danielfbm/k8s-design-workshop/controller/api/v1alpha1"
+)
+
+// shortRevision revision shown for a content hash
+func shortRevision(hash string) string {
+	if len(hash) > 10 {
+		return hash[:10]
+	}
+	return hash
+}
+
+// stagedUpdate an update changing the data of a copy, subject to the rollout strategy
+type stagedUpdate struct {
+	cluster *clusterPlan
+	// actions writing the copy and its shards, the copy last
+	actions []int
+}
+
+// copy returns the action writing the copy itself
+func (u *stagedUpdate) copy() *copyAction {
+	return &u.cluster.actions[u.actions[len(u.actions)-1]]
+}
+
+// rolloutUpdate returns true when the action changes the data of an existing copy
+func rolloutUpdate(action *copyAction) bool {
+	return action.operation == operationUpdate &&
+		action.current.Annotations[replicav1alpha1.ContentHashAnnotation] != action.desired.Annotations[replicav1alpha1.ContentHashAnnotation]
+}
+
+// waveOf returns the index of the first wave matching the namespace labels,
+// len(waves) for the default wave
+func waveOf(waves []replicav1alpha1.RolloutWave, nsLabels map[string]string) int {
+	for i, wave := range waves {
+		if labels.SelectorFromSet(wave.Selector).Matches(labels.Set(nsLabels)) {
+			return i
+		}
+	}
+	return len(waves)
+}
+
+// stageRollout holds back the data updates outside the current wave of the rollout strategy
+// and records the progress in the rollout status. Held back copies keep reporting the revision
+// they are on. With verification, the consumers of updated copies are checked before more copies
+// are updated and the copies are reverted when they degrade.
+// It returns how long the rollout waits, 0 when it does not wait for time to pass
+func (r *replication) stageRollout(ctx context.Context, plan *replicationPlan) time.Duration {
+	strategy := r.spec.RolloutStrategy
+	if strategy == nil {
+		r.status.Rollout = nil
+		removeCondition(r.status, replicav1alpha1.ConditionRolloutFailed)
+		return 0
+	}
+	waves := strategy.Waves
+	revision := plan.revision
+
+	// updates and copies of each wave, the last one being the default wave
+	staged := make([][]stagedUpdate, len(waves)+1)
+	sizes := make([]int, len(waves)+1)
+	for _, cp := range plan.clusters {
+		for _, status := range cp.statuses {
+			if status.Reason == "" {
+				sizes[waveOf(waves, cp.namespaceLabels[status.Namespace])]++
+			}
+		}
+		// copies with a data update are staged with all their writes
+		updated := map[int]bool{}
+		for i := range cp.actions {
+			if rolloutUpdate(&cp.actions[i]) {
+				updated[cp.actions[i].status] = true
+			}
+		}
+		byStatus := map[int]*stagedUpdate{}
+		var order []int
+		for i, action := range cp.actions {
+			if !updated[action.status] {
+				continue
+			}
+			if byStatus[action.status] == nil {
+				byStatus[action.status] = &stagedUpdate{cluster: cp}
+				order = append(order, action.status)
+			}
+			byStatus[action.status].actions = append(byStatus[action.status].actions, i)
+		}
+		for _, status := range order {
+			wave := waveOf(waves, cp.namespaceLabels[cp.statuses[status].Namespace])
+			staged[wave] = append(staged[wave], *byStatus[status])
+		}
+	}
+
+	current := 0
+	for current < len(staged) && len(staged[current]) == 0 {
+		current++
+	}
+	rollout := r.status.Rollout
+	if rollout == nil || rollout.Revision != revision {
+		rollout = &replicav1alpha1.RolloutStatus{Revision: revision}
+		if current < len(staged) {
+			if previous := staged[current][0].copy().current; previous != nil {
+				rollout.PreviousRevision = shortRevision(previous.Annotations[replicav1alpha1.ContentHashAnnotation])
+			}
+		}
+		removeCondition(r.status, replicav1alpha1.ConditionRolloutFailed)
+	}
+	r.status.Rollout = rollout
+	now := metav1.Now()
+
+	// a failed rollout stays halted until the template changes
+	if findCondition(r.status, replicav1alpha1.ConditionRolloutFailed) != nil {
+		holdUpdates(staged, 0, 0)
+		rollout.Message = "halted, change the template to roll out a new revision"
+		return 0
+	}
+	if rollout.VerificationStartTime != nil {
+		if wait, ok := r.verifyRollout(ctx, plan, staged); !ok || wait > 0 {
+			holdUpdates(staged, 0, 0)
+			return wait
+		}
+	}
+
+	if current == len(staged) {
+		if rollout.Wave != "" || rollout.LastTransitionTime.IsZero() {
+			rollout.Wave, rollout.LastTransitionTime, rollout.PausedUntil = "", now, nil
+		}
+		rollout.Message = ""
+		return 0
+	}
+
+	wave := replicav1alpha1.RolloutWave{Name: replicav1alpha1.DefaultWave}
+	if current < len(waves) {
+		wave = waves[current]
+	}
+	if rollout.Wave != wave.Name {
+		// a previous wave of the same revision completed
+		if rollout.Wave != "" && strategy.Pause != nil {
+			until := metav1.NewTime(now.Add(strategy.Pause.Duration))
+			rollout.PausedUntil = &until
+		}
+		rollout.Wave, rollout.LastTransitionTime = wave.Name, now
+	}
+
+	// copies of the current wave that may be updated now
+	allowed := 0
+	var wait time.Duration
+	switch {
+	case rollout.PausedUntil != nil && now.Before(rollout.PausedUntil):
+		wait = rollout.PausedUntil.Sub(now.Time)
+		rollout.Message = fmt.Sprintf("paused until %s", rollout.PausedUntil.UTC().Format(time.RFC3339))
+	case wave.ManualPromotion && r.owner.GetAnnotations()[replicav1alpha1.PromotedWaveAnnotation] != wave.Name+"@"+revision:
+		rollout.Message = fmt.Sprintf("waiting for promotion, set the %s annotation to %s@%s", replicav1alpha1.PromotedWaveAnnotation, wave.Name, revision)
+	default:
+		rollout.PausedUntil, rollout.Message = nil, ""
+		allowed = len(staged[current])
+		if wave.BatchSize != nil {
+			batch, err := intstr.GetValueFromIntOrPercent(wave.BatchSize, sizes[current], true)
+			if err != nil {
+				r.log.Error(err, "invalid batch size", "wave", wave.Name)
+			}
+			if batch < 1 {
+				batch = 1
+			}
+			if batch < allowed {
+				allowed = batch
+			}
+		}
+		if strategy.Verification != nil {
+			rollout.VerificationStartTime = &now
+			wait = verificationInterval
+		}
+	}
+	holdUpdates(staged, current, allowed)
+	return wait
+}
+
+// holdUpdates removes the staged updates from their plan but the first allowed ones
+// of wave current. Held back copies are ready on the revision they are on
+func holdUpdates(staged [][]stagedUpdate, current, allowed int) {
+	held := make(map[*clusterPlan]map[int]bool)
+	for i := current; i < len(staged); i++ {
+		for j := range staged[i] {
+			update := &staged[i][j]
+			if i == current && j < allowed {
+				continue
+			}
+			if held[update.cluster] == nil {
+				held[update.cluster] = map[int]bool{}
+			}
+			for _, action := range update.actions {
+				held[update.cluster][action] = true
+			}
+			if previous := update.copy().current; previous != nil {
+				status := &update.cluster.statuses[update.copy().status]
+				status.Ready = true
+				status.Revision = shortRevision(previous.Annotations[replicav1alpha1.ContentHashAnnotation])
+			}
+		}
+	}
+	for cp, actions := range held {
+		kept := cp.actions[:0]
+		for i, action := range cp.actions {
+			if !actions[i] {
+				kept = append(kept, action)
+			}
+		}
+		cp.actions = kept
+	}
+}
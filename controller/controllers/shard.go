@@ -0,0 +1,128 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"unicode/utf8"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	replicav1alpha1 "github.com/danielfbm/k8s-design-workshop/controller/api/v1alpha1"
+)
+
+const (
+	// defaultMaxShardBytes shard size when the replica does not set one
+	defaultMaxShardBytes = 900 * 1024
+	// shardIndexKey index ConfigMap key holding the shard index
+	shardIndexKey = "index.json"
+)
+
+// shardIndex content of the index ConfigMap of sharded data. Consumers mounting the index and
+// its shards in one projected volume rebuild each key by concatenating its parts in order
+type shardIndex struct {
+	// ContentHash hash of the whole data
+	ContentHash string `json:"contentHash"`
+	// Shards names of the shard ConfigMaps
+	Shards []string `json:"shards"`
+	// Keys parts of each data key, as <shard>/<key>
+	Keys map[string][]string `json:"keys"`
+}
+
+// shardBase splits the data of base across shards when it exceeds the shard size of the
+// replica, turning base into the index listing them. It returns the shards, none when the
+// data fits in base
+func (r *replication) shardBase(base *corev1.ConfigMap) ([]*corev1.ConfigMap, error) {
+	if r.spec.Sharding == nil {
+		return nil, nil
+	}
+	limit := defaultMaxShardBytes
+	if r.spec.Sharding.MaxShardBytes != nil {
+		limit = int(*r.spec.Sharding.MaxShardBytes)
+	}
+	if dataSize(base.Data) <= limit {
+		return nil, nil
+	}
+
+	index := shardIndex{ContentHash: base.Annotations[replicav1alpha1.ContentHashAnnotation], Keys: map[string][]string{}}
+	var shards []*corev1.ConfigMap
+	size := limit
+	add := func(key, part, value string) {
+		if size+len(part)+len(value) > limit {
+			shard := base.DeepCopy()
+			shard.Name = fmt.Sprintf("%s-%d", base.Name, len(shards))
+			shard.Data = map[string]string{}
+			shards = append(shards, shard)
+			index.Shards = append(index.Shards, shard.Name)
+			size = 0
+		}
+		shard := shards[len(shards)-1]
+		shard.Data[part] = value
+		size += len(part) + len(value)
+		index.Keys[key] = append(index.Keys[key], shard.Name+"/"+part)
+	}
+
+	keys := make([]string, 0, len(base.Data))
+	for k := range base.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := base.Data[key]
+		if len(key)+len(value) <= limit {
+			add(key, key, value)
+			continue
+		}
+		// values larger than a shard are split in chunks, never inside a character
+		for i, start := 0, 0; start < len(value); i++ {
+			part := partKey(key, i)
+			end := start + limit - len(part)
+			if end >= len(value) {
+				end = len(value)
+			}
+			for end < len(value) && end > start && !utf8.RuneStart(value[end]) {
+				end--
+			}
+			add(key, part, value[start:end])
+			start = end
+		}
+	}
+
+	for _, shard := range shards {
+		shard.Annotations = map[string]string{replicav1alpha1.ContentHashAnnotation: contentHash(shard.Data)}
+	}
+	raw, err := json.Marshal(index)
+	if err != nil {
+		return nil, err
+	}
+	base.Data = map[string]string{shardIndexKey: string(raw)}
+	base.Annotations[replicav1alpha1.ContentHashAnnotation] = contentHash(base.Data)
+	return shards, nil
+}
+
+// partKey names the chunk i of a value split across shards <key>.part-<i>. Keys too long for
+// the suffix are replaced by their hash, the index still maps the chunks to the original key
+func partKey(key string, i int) string {
+	part := fmt.Sprintf("%s.part-%d", key, i)
+	if len(part) <= validation.DNS1123SubdomainMaxLength {
+		return part
+	}
+	sum := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("%s.part-%d", hex.EncodeToString(sum[:]), i)
+}
+
+// indexedShards returns the shards listed by the index of a copy, none when it is not sharded
+func indexedShards(cm *corev1.ConfigMap) []string {
+	raw, ok := cm.Data[shardIndexKey]
+	if !ok {
+		return nil
+	}
+	index := shardIndex{}
+	if err := json.Unmarshal([]byte(raw), &index); err != nil {
+		return nil
+	}
+	return index.Shards
+}
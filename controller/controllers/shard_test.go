@@ -0,0 +1,92 @@
+package controllers
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	replicav1alpha1 "github.com/danielfbm/k8s-design-workshop/controller/api/v1alpha1"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+var _ = Describe("replication.shardBase", func() {
+
+	var (
+		rep  *replication
+		base *corev1.ConfigMap
+	)
+
+	BeforeEach(func() {
+		maxShardBytes := int32(1024)
+		rep = &replication{
+			owner: &replicav1alpha1.ConfigMapReplica{ObjectMeta: metav1.ObjectMeta{Name: "sharded"}},
+			spec:  &replicav1alpha1.ConfigMapReplicaSpec{Sharding: &replicav1alpha1.Sharding{MaxShardBytes: &maxShardBytes}},
+		}
+		base = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "sharded"}}
+	})
+
+	// rebuild reassembles the data of base and its shards the way consumers do
+	rebuild := func(base *corev1.ConfigMap, shards []*corev1.ConfigMap) map[string]string {
+		index := shardIndex{}
+		Expect(json.Unmarshal([]byte(base.Data[shardIndexKey]), &index)).To(Succeed())
+		byName := map[string]*corev1.ConfigMap{}
+		for _, shard := range shards {
+			byName[shard.Name] = shard
+		}
+		data := map[string]string{}
+		for key, parts := range index.Keys {
+			for _, part := range parts {
+				split := strings.SplitN(part, "/", 2)
+				Expect(byName).To(HaveKey(split[0]), "should list existing shards")
+				data[key] += byName[split[0]].Data[split[1]]
+			}
+		}
+		return data
+	}
+
+	It("should keep data within a shard in base", func() {
+		base.Data = map[string]string{"small.txt": "small"}
+		base.Annotations = map[string]string{replicav1alpha1.ContentHashAnnotation: contentHash(base.Data)}
+
+		shards, err := rep.shardBase(base)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(shards).To(BeEmpty())
+		Expect(base.Data).To(Equal(map[string]string{"small.txt": "small"}))
+	})
+
+	It("should split large values without exceeding the shard size", func() {
+		data := map[string]string{"big.txt": strings.Repeat("é", 1500), "small.txt": "small"}
+		base.Data = data
+		base.Annotations = map[string]string{replicav1alpha1.ContentHashAnnotation: contentHash(data)}
+
+		shards, err := rep.shardBase(base)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(len(shards)).To(BeNumerically(">", 2))
+		for i, shard := range shards {
+			Expect(shard.Name).To(Equal("sharded-" + strconv.Itoa(i)))
+			Expect(dataSize(shard.Data)).To(BeNumerically("<=", 1024))
+		}
+		Expect(base.Data).To(HaveKey(shardIndexKey))
+		Expect(rebuild(base, shards)).To(Equal(data), "should split on character boundaries")
+	})
+
+	It("should keep chunk keys of long keys valid", func() {
+		key := strings.Repeat("k", validation.DNS1123SubdomainMaxLength)
+		data := map[string]string{key: strings.Repeat("x", 3000)}
+		base.Data = data
+		base.Annotations = map[string]string{replicav1alpha1.ContentHashAnnotation: contentHash(data)}
+
+		shards, err := rep.shardBase(base)
+		Expect(err).ToNot(HaveOccurred())
+		for _, shard := range shards {
+			for k := range shard.Data {
+				Expect(validation.IsConfigMapKey(k)).To(BeEmpty(), "chunk key %s", k)
+			}
+		}
+		Expect(rebuild(base, shards)).To(Equal(data))
+	})
+})
@@ -0,0 +1,276 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	replicav1alpha1 "github.com/danielfbm/k8s-design-workshop/controller/api/v1alpha1"
+)
+
+const (
+	// defaultSourceInterval time between fetches when an HTTPSource does not set one
+	defaultSourceInterval = 5 * time.Minute
+	// sourceRequestTimeout maximum time a single fetch may take
+	sourceRequestTimeout = 30 * time.Second
+	// sourceRetryPeriod time until a failed fetch is retried
+	sourceRetryPeriod = time.Minute
+	// maxSourceBytes largest document a source may return, the size limit of a ConfigMap
+	maxSourceBytes = 1 << 20
+	// maxShardedSourceBytes largest document a source of a sharded replica may return
+	maxShardedSourceBytes = 16 << 20
+)
+
+// httpSources fetches the HTTPSources of replicas and keeps the last good
+// document per replica, so failures and unchanged documents (ETag) reuse it
+type httpSources struct {
+	// reader reads header Secrets without caching them in the manager
+	reader client.Reader
+	client *http.Client
+
+	mu        sync.Mutex
+	documents map[types.NamespacedName]*fetchedDocument
+}
+
+// fetchedDocument last good response of a source
+type fetchedDocument struct {
+	url     string
+	etag    string
+	body    []byte
+	fetched time.Time
+}
+
+func newHTTPSources(reader client.Reader) *httpSources {
+	return &httpSources{
+		reader:    reader,
+		client:    &http.Client{Timeout: sourceRequestTimeout},
+		documents: map[types.NamespacedName]*fetchedDocument{},
+	}
+}
+
+// fetch returns the data of a replica source, fetching it again once the interval elapsed.
+// When fetching fails the data of the last good document is returned with the error,
+// data is nil if there never was a good document. next is when the source should be fetched again.
+// Documents larger than limit bytes are rejected
+func (s *httpSources) fetch(ctx context.Context, replica types.NamespacedName, source *replicav1alpha1.HTTPSource, limit int) (data map[string]string, next time.Duration, err error) {
+	interval := defaultSourceInterval
+	if source.Interval != nil && source.Interval.Duration > 0 {
+		interval = source.Interval.Duration
+	}
+
+	s.mu.Lock()
+	doc := s.documents[replica]
+	s.mu.Unlock()
+	if doc != nil && doc.url != source.URL {
+		doc = nil
+	}
+
+	next = interval
+	if doc == nil || time.Since(doc.fetched) >= interval {
+		var fetched *fetchedDocument
+		if fetched, err = s.get(ctx, replica.Namespace, source, doc, limit); err == nil {
+			doc = fetched
+			s.mu.Lock()
+			s.documents[replica] = doc
+			s.mu.Unlock()
+		} else if next > sourceRetryPeriod {
+			next = sourceRetryPeriod
+		}
+	} else {
+		next = interval - time.Since(doc.fetched)
+	}
+	if doc == nil {
+		return nil, next, err
+	}
+
+	data, mapErr := mapDocument(doc.body, source.KeyMapping)
+	if mapErr != nil {
+		return nil, next, mapErr
+	}
+	return data, next, err
+}
+
+// syncSource fetches the source of a replica into its replication and reports
+// failures in the SourceFetchFailed condition. It returns false when there is
+// no good data yet, in which case the copies should be left untouched
+func (s *httpSources) syncSource(ctx context.Context, replica types.NamespacedName, rep *replication) (next time.Duration, ok bool) {
+	if rep.spec.Source == nil || rep.spec.Source.HTTP == nil {
+		rep.sourceData = nil
+		removeCondition(rep.status, replicav1alpha1.ConditionSourceFetchFailed)
+		s.forget(replica)
+		return 0, true
+	}
+
+	source := rep.spec.Source.HTTP
+	var data map[string]string
+	var err error
+	if ref := source.HeadersFromSecret; ref != nil && replica.Namespace != "" && ref.Namespace != "" && ref.Namespace != replica.Namespace {
+		err = fmt.Errorf("headersFromSecret must be in namespace %s", replica.Namespace)
+	} else if ref != nil {
+		// without it anyone able to create a replica could send any Secret to a server of their choosing
+		namespace := replica.Namespace
+		if ref.Namespace != "" {
+			namespace = ref.Namespace
+		}
+		err = rep.readableSecret(ctx, namespace, "headersFromSecret")
+	}
+	if err == nil {
+		// sharded data may be larger than a ConfigMap
+		limit := maxSourceBytes
+		if rep.spec.Sharding != nil {
+			limit = maxShardedSourceBytes
+		}
+		data, next, err = s.fetch(ctx, replica, source, limit)
+	}
+	if err != nil {
+		rep.log.Error(err, "fetching source", "url", source.URL)
+		message := err.Error()
+		if data != nil {
+			message += ", copies keep the last good data"
+		}
+		setCondition(rep.status, replicav1alpha1.ConditionSourceFetchFailed, corev1.ConditionTrue, "FetchFailed", message)
+	} else {
+		removeCondition(rep.status, replicav1alpha1.ConditionSourceFetchFailed)
+	}
+	rep.sourceData = data
+	return next, data != nil
+}
+
+// forget drops the document of a deleted replica
+func (s *httpSources) forget(replica types.NamespacedName) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.documents, replica)
+}
+
+// get requests the document, sending the ETag of the last good one.
+// On 304 Not Modified the last good document is returned with a new fetch time
+func (s *httpSources) get(ctx context.Context, namespace string, source *replicav1alpha1.HTTPSource, last *fetchedDocument, limit int) (*fetchedDocument, error) {
+	req, err := http.NewRequest(http.MethodGet, source.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json, application/yaml")
+	if source.HeadersFromSecret != nil {
+		if err = s.setHeaders(ctx, req, namespace, source.HeadersFromSecret); err != nil {
+			return nil, err
+		}
+	}
+	if last != nil && last.etag != "" {
+		req.Header.Set("If-None-Match", last.etag)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && last != nil {
+		return &fetchedDocument{url: last.url, etag: last.etag, body: last.body, fetched: time.Now()}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: unexpected status %s", source.URL, resp.Status)
+	}
+	// one byte more than the limit tells a document at the limit from a larger one
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > limit {
+		return nil, fmt.Errorf("GET %s: document larger than %d bytes", source.URL, limit)
+	}
+	// make sure a bad document never replaces the last good one
+	if _, err = mapDocument(body, nil); err != nil {
+		return nil, fmt.Errorf("GET %s: %v", source.URL, err)
+	}
+	return &fetchedDocument{url: source.URL, etag: resp.Header.Get("ETag"), body: body, fetched: time.Now()}, nil
+}
+
+// setHeaders adds every key of the Secret as a request header
+func (s *httpSources) setHeaders(ctx context.Context, req *http.Request, namespace string, ref *replicav1alpha1.SecretReference) error {
+	if ref.Namespace != "" {
+		namespace = ref.Namespace
+	}
+	secret := &corev1.Secret{}
+	if err := s.reader.Get(ctx, types.NamespacedName{Namespace: namespace, Name: ref.Name}, secret); err != nil {
+		return err
+	}
+	for k, v := range secret.Data {
+		req.Header.Set(k, string(v))
+	}
+	return nil
+}
+
+// mapDocument converts a JSON or YAML document into ConfigMap data
+func mapDocument(body []byte, keyMapping map[string]string) (map[string]string, error) {
+	raw, err := yaml.YAMLToJSON(body)
+	if err != nil {
+		return nil, err
+	}
+	var document interface{}
+	if err = json.Unmarshal(raw, &document); err != nil {
+		return nil, err
+	}
+
+	data := map[string]string{}
+	if len(keyMapping) == 0 {
+		fields, ok := document.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("document is not an object, a keyMapping is required")
+		}
+		for k, v := range fields {
+			if data[k], err = documentValue(v); err != nil {
+				return nil, err
+			}
+		}
+		return data, nil
+	}
+
+	for key, path := range keyMapping {
+		value, ok := lookupPath(document, path)
+		if !ok {
+			return nil, fmt.Errorf("keyMapping %s: path %s not found in document", key, path)
+		}
+		if data[key], err = documentValue(value); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// lookupPath follows a dot separated path of object fields
+func lookupPath(document interface{}, path string) (interface{}, bool) {
+	current := document
+	for _, field := range strings.Split(path, ".") {
+		fields, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = fields[field]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// documentValue strings are copied as is, everything else is encoded as JSON
+func documentValue(value interface{}) (string, error) {
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	raw, err := json.Marshal(value)
+	return string(raw), err
+}
@@ -0,0 +1,28 @@
+package controllers
+
+import (
+	replicav1alpha1 "github.com/danielfbm/k8s-design-workshop/controller/api/v1alpha1"
+)
+
+// suspendedStatuses returns the copy statuses of a suspended replica. Copies the plan
+// would write are not ready, those changed outside the replica are reported as drifted
+func (r *replication) suspendedStatuses(plan *replicationPlan) []replicav1alpha1.ConfigMapReplicaCopy {
+	for _, cp := range plan.clusters {
+		for _, action := range cp.actions {
+			if action.status < 0 {
+				continue
+			}
+			status := &cp.statuses[action.status]
+			status.Revision = ""
+			if action.current != nil {
+				status.Revision = shortRevision(action.current.Annotations[replicav1alpha1.ContentHashAnnotation])
+			}
+			if action.current != nil && r.manages(action.current) && r.drifted(action.current) {
+				status.Reason, status.Message = replicav1alpha1.ReasonDrifted, "configmap was changed outside the replica"
+			} else {
+				status.Reason, status.Message = replicav1alpha1.ReasonSuspended, "replication is suspended"
+			}
+		}
+	}
+	return plan.statuses()
+}
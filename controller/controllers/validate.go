@@ -0,0 +1,159 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/magiconair/properties"
+	"github.com/xeipuuv/gojsonschema"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	replicav1alpha1 "github.com/danielfbm/k8s-design-workshop/controller/api/v1alpha1"
+)
+
+// maxSchemaErrors schema violations reported for a key
+const maxSchemaErrors = 3
+
+// validateData validates the data of the copies against the validation rules of the replica
+// and reports failures in the ValidationFailed condition. It returns false when the data is
+// invalid, in which case the copies should be left untouched.
+// Errors in decrypted values do not quote the value
+func validateData(ctx context.Context, reader client.Reader, replica types.NamespacedName, rep *replication) bool {
+	if len(rep.spec.Validation) == 0 {
+		removeCondition(rep.status, replicav1alpha1.ConditionValidationFailed)
+		return true
+	}
+
+	data := rep.data()
+	for _, rule := range rep.spec.Validation {
+		value, ok := data[rule.Key]
+		if !ok {
+			continue
+		}
+		_, encrypted := rep.decrypted[rule.Key]
+		if _, fetched := rep.sourceData[rule.Key]; fetched {
+			encrypted = false
+		}
+		if err := validateValue(ctx, reader, replica.Namespace, rule, value, encrypted); err != nil {
+			rep.log.Info("invalid data", "key", rule.Key, "error", err.Error())
+			setCondition(rep.status, replicav1alpha1.ConditionValidationFailed, corev1.ConditionTrue, "InvalidData",
+				fmt.Sprintf("key %s: %v", rule.Key, err))
+			return false
+		}
+	}
+	removeCondition(rep.status, replicav1alpha1.ConditionValidationFailed)
+	return true
+}
+
+// validateValue parses the value in the format of the rule and checks it against its schema
+func validateValue(ctx context.Context, reader client.Reader, namespace string, rule replicav1alpha1.DataValidation, value string, encrypted bool) error {
+	doc, err := parseValue(rule.Format, value)
+	if err != nil {
+		if encrypted {
+			return fmt.Errorf("encrypted value is not valid %s", rule.Format)
+		}
+		return fmt.Errorf("invalid %s: %v", rule.Format, err)
+	}
+	if rule.Schema == nil {
+		return nil
+	}
+
+	source := rule.Schema.Inline
+	if ref := rule.Schema.ConfigMapRef; ref != nil {
+		if source, err = schemaDocument(ctx, reader, namespace, ref); err != nil {
+			return err
+		}
+	}
+	schema, err := gojsonschema.NewSchema(gojsonschema.NewStringLoader(source))
+	if err != nil {
+		return fmt.Errorf("schema: %v", err)
+	}
+	result, err := schema.Validate(gojsonschema.NewGoLoader(doc))
+	if err != nil {
+		return fmt.Errorf("schema: %v", err)
+	}
+	if result.Valid() {
+		return nil
+	}
+	var violations []string
+	for i, violation := range result.Errors() {
+		if i == maxSchemaErrors {
+			violations = append(violations, fmt.Sprintf("and %d more", len(result.Errors())-maxSchemaErrors))
+			break
+		}
+		violations = append(violations, violation.Field()+": "+violation.Description())
+	}
+	return fmt.Errorf("does not match the schema: %s", strings.Join(violations, ", "))
+}
+
+// parseValue parses a value in one of the data formats. Errors carry the position of the error
+func parseValue(format replicav1alpha1.DataFormat, value string) (interface{}, error) {
+	var doc interface{}
+	switch format {
+	case replicav1alpha1.DataFormatJSON:
+		if err := json.Unmarshal([]byte(value), &doc); err != nil {
+			if syntax, ok := err.(*json.SyntaxError); ok {
+				line, column := position(value, syntax.Offset)
+				return nil, fmt.Errorf("line %d column %d: %v", line, column, err)
+			}
+			return nil, err
+		}
+	case replicav1alpha1.DataFormatYAML:
+		if err := yaml.Unmarshal([]byte(value), &doc); err != nil {
+			return nil, fmt.Errorf("%s", strings.TrimPrefix(err.Error(), "error converting YAML to JSON: "))
+		}
+	case replicav1alpha1.DataFormatTOML:
+		table := map[string]interface{}{}
+		if _, err := toml.Decode(value, &table); err != nil {
+			return nil, err
+		}
+		doc = table
+	case replicav1alpha1.DataFormatProperties:
+		props, err := properties.LoadString(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s", strings.TrimPrefix(err.Error(), "properties: "))
+		}
+		doc = props.Map()
+	default:
+		return nil, fmt.Errorf("unknown format")
+	}
+	return doc, nil
+}
+
+// position returns the line and column of a byte offset, both starting at 1
+func position(value string, offset int64) (int, int) {
+	if offset > int64(len(value)) {
+		offset = int64(len(value))
+	}
+	before := value[:offset]
+	line := strings.Count(before, "\n") + 1
+	return line, len(before) - strings.LastIndex(before, "\n")
+}
+
+// schemaDocument reads a JSON Schema document from a ConfigMap
+func schemaDocument(ctx context.Context, reader client.Reader, namespace string, ref *replicav1alpha1.ConfigMapKeyReference) (string, error) {
+	key := types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}
+	switch {
+	case ref.Namespace == "" && namespace == "":
+		return "", fmt.Errorf("schema.configMapRef.namespace is required")
+	case ref.Namespace == "":
+		key.Namespace = namespace
+	case namespace != "" && ref.Namespace != namespace:
+		return "", fmt.Errorf("schema.configMapRef must be in namespace %s", namespace)
+	}
+	cm := &corev1.ConfigMap{}
+	if err := reader.Get(ctx, key, cm); err != nil {
+		return "", fmt.Errorf("schema: %v", err)
+	}
+	source, ok := cm.Data[ref.Key]
+	if !ok {
+		return "", fmt.Errorf("schema: configmap %s has no key %s", key, ref.Key)
+	}
+	return source, nil
+}
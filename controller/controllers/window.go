@@ -0,0 +1,137 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+
+	replicav1alpha1 "github.com/danielfbm/k8s-design-workshop/controller/api/v1alpha1"
+)
+
+// windowState whether a maintenance window is open and when it opens next
+type windowState struct {
+	selector labels.Selector
+	open     bool
+	// next opening, zero when open or when it can not be evaluated
+	next time.Time
+}
+
+// withinWindows holds back the writes to namespaces whose maintenance windows are all closed.
+// Held back copies are reported as PendingWindow until the next window opens.
+// It returns how long until the first held back write may be made, 0 when nothing is held
+func (r *replication) withinWindows(ctx context.Context, plan *replicationPlan) time.Duration {
+	if len(r.spec.Windows) == 0 {
+		return 0
+	}
+	now := time.Now()
+	windows := make([]windowState, len(r.spec.Windows))
+	for i := range r.spec.Windows {
+		window := &r.spec.Windows[i]
+		open, next, err := window.Open(now)
+		if err != nil {
+			// a window that can not be evaluated never opens
+			r.log.Error(err, "invalid maintenance window", "window", i)
+		}
+		windows[i] = windowState{selector: labels.SelectorFromSet(window.Selector), open: open, next: next}
+	}
+
+	var first time.Time
+	for _, cp := range plan.clusters {
+		kept := cp.actions[:0]
+		for _, action := range cp.actions {
+			namespace := action.object().Namespace
+			// namespaces whose labels are unknown are held until the next sync
+			allowed, next := false, time.Time{}
+			if nsLabels, err := r.namespaceLabels(ctx, cp, namespace); err != nil {
+				cp.log.Error(err, "namespace labels", "namespace", namespace)
+			} else {
+				allowed, next = windowsOpen(windows, nsLabels)
+			}
+			if allowed {
+				kept = append(kept, action)
+				continue
+			}
+			message := "waiting for a maintenance window"
+			if !next.IsZero() {
+				message = fmt.Sprintf("waiting for the maintenance window opening at %s", next.UTC().Format(time.RFC3339))
+				if first.IsZero() || next.Before(first) {
+					first = next
+				}
+			}
+			if action.status < 0 {
+				cp.statuses = append(cp.statuses, replicav1alpha1.ConfigMapReplicaCopy{
+					Cluster:   cp.cluster.name,
+					Name:      action.current.Name,
+					Namespace: action.current.Namespace,
+					Reason:    replicav1alpha1.ReasonPendingWindow,
+					Message:   string(action.operation) + " " + message,
+				})
+				continue
+			}
+			status := &cp.statuses[action.status]
+			status.Ready = false
+			status.Reason, status.Message = replicav1alpha1.ReasonPendingWindow, string(action.operation)+" "+message
+			status.Revision = ""
+			if action.current != nil {
+				status.Revision = shortRevision(action.current.Annotations[replicav1alpha1.ContentHashAnnotation])
+			}
+		}
+		cp.actions = kept
+	}
+	if first.IsZero() {
+		return 0
+	}
+	return first.Sub(now)
+}
+
+// windowsOpen returns true when no window applies to the namespace labels or one of them is open,
+// otherwise it returns the earliest next opening of the windows applying
+func windowsOpen(windows []windowState, nsLabels map[string]string) (bool, time.Time) {
+	applies := false
+	var next time.Time
+	for _, window := range windows {
+		if !window.selector.Matches(labels.Set(nsLabels)) {
+			continue
+		}
+		if window.open {
+			return true, time.Time{}
+		}
+		applies = true
+		if !window.next.IsZero() && (next.IsZero() || window.next.Before(next)) {
+			next = window.next
+		}
+	}
+	return !applies, next
+}
+
+// namespaceLabels returns the labels of a namespace of the cluster, fetching those
+// of namespaces no longer targeted
+func (r *replication) namespaceLabels(ctx context.Context, cp *clusterPlan, namespace string) (map[string]string, error) {
+	if nsLabels, ok := cp.namespaceLabels[namespace]; ok {
+		return nsLabels, nil
+	}
+	ns := &corev1.Namespace{}
+	if err := cp.cluster.Get(ctx, types.NamespacedName{Name: namespace}, ns); err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+	if cp.namespaceLabels == nil {
+		cp.namespaceLabels = map[string]map[string]string{}
+	}
+	cp.namespaceLabels[namespace] = ns.Labels
+	return ns.Labels, nil
+}
+
+// pendingWindow returns true when copies wait for a maintenance window
+func pendingWindow(status *replicav1alpha1.ConfigMapReplicaStatus) bool {
+	for _, cp := range status.ConfigMapStatuses {
+		if cp.Reason == replicav1alpha1.ReasonPendingWindow {
+			return true
+		}
+	}
+	return false
+}
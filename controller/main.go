@@ -2,10 +2,13 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
+	"strings"
 
 	replicav1alpha1 "github.com/danielfbm/k8s-design-workshop/controller/api/v1alpha1"
 	"github.com/danielfbm/k8s-design-workshop/controller/controllers"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
@@ -29,15 +32,56 @@ func init() {
 func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
+	var tenantLabel string
+	var checkAccess bool
+	var enableWebhooks bool
+	var protectedNamespaces string
+	var controllerUsername string
+	var maxChanges int
+	var clusterMaxCopies int
+	var clusterMaxBytes string
+	var revisionNamespace string
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&tenantLabel, "tenant-label", controllers.DefaultTenantLabel,
+		"Namespace label identifying the tenant of a namespace. NamespacedConfigMapReplicas only write to namespaces of their own tenant.")
+	flag.BoolVar(&checkAccess, "check-access", true,
+		"Only copy to namespaces where the author or service account of a replica may create and update ConfigMaps.")
+	flag.BoolVar(&enableWebhooks, "enable-webhooks", true,
+		"Serve the admission webhooks. The author webhook is required to use --check-access without setting a serviceAccountName.")
+	flag.StringVar(&protectedNamespaces, "protected-namespaces", strings.Join(controllers.DefaultProtectedNamespaces, ","),
+		"Comma separated namespaces replicas only write to when listing them explicitly and a ReplicationPolicy allows it, "+
+			"and aggregators only collect from when listing them explicitly and write to when a ReplicationPolicy allows it. "+
+			"The namespace in the POD_NAMESPACE environment variable is always protected.")
+	flag.StringVar(&controllerUsername, "controller-username", serviceAccountUsername(),
+		"User the controller runs as, the only one besides the garbage collector allowed to change copies. "+
+			"Defaults to the service account in the POD_NAMESPACE and SERVICE_ACCOUNT_NAME environment variables.")
+	flag.IntVar(&maxChanges, "max-changes", 0,
+		"Copies a single sync of a replica may create, update or delete before it needs approval. 0 disables the limit.")
+	flag.IntVar(&clusterMaxCopies, "cluster-max-copies", 0,
+		"Copies all replicas together may write. 0 disables the limit.")
+	flag.StringVar(&clusterMaxBytes, "cluster-max-bytes", "",
+		"Bytes of data all copies together may hold, as a quantity such as 100Mi. Empty disables the limit.")
+	flag.StringVar(&revisionNamespace, "revision-namespace", os.Getenv("POD_NAMESPACE"),
+		"Namespace the template revisions of ConfigMapReplicas are stored in. Defaults to the POD_NAMESPACE environment variable, or the default namespace.")
 	flag.Parse()
 
+	protected := splitList(protectedNamespaces)
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		protected = append(protected, ns)
+	}
+
 	ctrl.SetLogger(zap.New(func(o *zap.Options) {
 		o.Development = true
 	}))
 
+	clusterQuota, err := newClusterQuota(clusterMaxCopies, clusterMaxBytes)
+	if err != nil {
+		setupLog.Error(err, "invalid cluster quota")
+		os.Exit(1)
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:             scheme,
 		MetricsBindAddress: metricsAddr,
@@ -50,13 +94,57 @@ func main() {
 	}
 
 	if err = (&controllers.ConfigMapReplicaReconciler{
-		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("ConfigMapReplica"),
-		Scheme: mgr.GetScheme(),
+		Client:              mgr.GetClient(),
+		Log:                 ctrl.Log.WithName("controllers").WithName("ConfigMapReplica"),
+		Scheme:              mgr.GetScheme(),
+		CheckAccess:         checkAccess,
+		ProtectedNamespaces: protected,
+		MaxChanges:          maxChanges,
+		ClusterQuota:        clusterQuota,
+		RevisionNamespace:   revisionNamespace,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "ConfigMapReplica")
 		os.Exit(1)
 	}
+	if err = (&controllers.NamespacedConfigMapReplicaReconciler{
+		Client:              mgr.GetClient(),
+		Log:                 ctrl.Log.WithName("controllers").WithName("NamespacedConfigMapReplica"),
+		Scheme:              mgr.GetScheme(),
+		TenantLabel:         tenantLabel,
+		CheckAccess:         checkAccess,
+		ProtectedNamespaces: protected,
+		MaxChanges:          maxChanges,
+		ClusterQuota:        clusterQuota,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "NamespacedConfigMapReplica")
+		os.Exit(1)
+	}
+	if err = (&controllers.ConfigMapAggregatorReconciler{
+		Client:              mgr.GetClient(),
+		Log:                 ctrl.Log.WithName("controllers").WithName("ConfigMapAggregator"),
+		Scheme:              mgr.GetScheme(),
+		ProtectedNamespaces: protected,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "ConfigMapAggregator")
+		os.Exit(1)
+	}
+	if enableWebhooks {
+		replicav1alpha1.SetupAuthorWebhookWithManager(mgr, controllerUsername)
+		if err = (&replicav1alpha1.ConfigMapReplica{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "ConfigMapReplica")
+			os.Exit(1)
+		}
+		if err = (&replicav1alpha1.NamespacedConfigMapReplica{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "NamespacedConfigMapReplica")
+			os.Exit(1)
+		}
+		replicav1alpha1.SetupValidationWebhookWithManager(mgr, clusterQuota, tenantLabel, protected)
+		editors := replicav1alpha1.DefaultCopyEditors
+		if controllerUsername != "" {
+			editors = append(editors, controllerUsername)
+		}
+		replicav1alpha1.SetupCopyWebhookWithManager(mgr, editors)
+	}
 	// +kubebuilder:scaffold:builder
 
 	setupLog.Info("starting manager")
@@ -65,3 +153,43 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// splitList splits a comma separated flag value dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// serviceAccountUsername username of the service account the manager runs as, empty outside a cluster
+func serviceAccountUsername() string {
+	namespace, name := os.Getenv("POD_NAMESPACE"), os.Getenv("SERVICE_ACCOUNT_NAME")
+	if namespace == "" || name == "" {
+		return ""
+	}
+	return "system:serviceaccount:" + namespace + ":" + name
+}
+
+// newClusterQuota builds the quota of all replicas together from the flags, nil when both are disabled
+func newClusterQuota(maxCopies int, maxBytes string) (*replicav1alpha1.ReplicaQuota, error) {
+	if maxCopies == 0 && maxBytes == "" {
+		return nil, nil
+	}
+	quota := &replicav1alpha1.ReplicaQuota{}
+	if maxCopies > 0 {
+		copies := int32(maxCopies)
+		quota.MaxCopies = &copies
+	}
+	if maxBytes != "" {
+		bytes, err := resource.ParseQuantity(maxBytes)
+		if err != nil {
+			return nil, fmt.Errorf("--cluster-max-bytes: %v", err)
+		}
+		quota.MaxBytes = &bytes
+	}
+	return quota, nil
+}